@@ -0,0 +1,96 @@
+package ath
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func newACMEManager(config Config) (*autocert.Manager, error) {
+	if config.ACME.AcceptTOS == false {
+		return nil, errors.New("--acme.accept-tos is required to obtain certificates with ACME")
+	}
+
+	cacheDirectory, err := acmeCacheDirectory(config.ACME.CacheDirectory, os.Getenv("STATE_DIRECTORY"))
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{DirectoryURL: config.ACME.Directory}
+	if len(config.ACME.CARoot) > 0 {
+		roots, err := loadCertPool(config.ACME.CARoot)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDirectory),
+		HostPolicy: autocert.HostWhitelist(config.ACME.Domains...),
+		Client:     client,
+		Email:      config.ACME.Email,
+	}, nil
+}
+
+// acmeCacheDirectory returns dir, or the acme subdirectory of the
+// state directory systemd sets with StateDirectory=, as the directory
+// where ACME accounts and certificates are kept.
+func acmeCacheDirectory(dir, stateDirectory string) (string, error) {
+	if len(dir) > 0 {
+		return dir, nil
+	}
+	// systemd separates multiple state directories with colons.
+	stateDirectory, _, _ = strings.Cut(stateDirectory, ":")
+	if len(stateDirectory) == 0 {
+		return "", errors.New("--acme.cache-dir is required to store ACME certificates, unless STATE_DIRECTORY is set")
+	}
+	return filepath.Join(stateDirectory, "acme"), nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	res := x509.NewCertPool()
+	if res.AppendCertsFromPEM(data) == false {
+		return nil, fmt.Errorf("no PEM certificate found in '%s'", path)
+	}
+	return res, nil
+}
+
+type certificateGetter func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// chainCertificateGetters returns the first certificate successfully
+// provided by getters.
+func chainCertificateGetters(getters ...certificateGetter) certificateGetter {
+	if len(getters) == 1 {
+		return getters[0]
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		var errs []error
+		for _, get := range getters {
+			cert, err := get(hello)
+			if err == nil && cert != nil {
+				return cert, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
@@ -0,0 +1,115 @@
+package ath
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type ACMESuite struct{}
+
+var _ = Suite(&ACMESuite{})
+
+func (s *ACMESuite) TestManager(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"--acme.domain", "example.com"})
+	c.Assert(err, IsNil)
+	c.Check(config.TLSEnabled(), Equals, true)
+
+	_, err = newACMEManager(config)
+	c.Check(err, ErrorMatches, "--acme.accept-tos is required.*")
+
+	config.ACME.AcceptTOS = true
+	config.ACME.CacheDirectory = c.MkDir()
+	manager, err := newACMEManager(config)
+	c.Assert(err, IsNil)
+	c.Check(manager.Client.DirectoryURL, Equals, "https://acme-v02.api.letsencrypt.org/directory")
+	c.Check(manager.HostPolicy(context.Background(), "example.com"), IsNil)
+	c.Check(manager.HostPolicy(context.Background(), "evil.com"), NotNil)
+
+	config.ACME.CARoot = filepath.Join(config.ACME.CacheDirectory, "missing.pem")
+	_, err = newACMEManager(config)
+	c.Check(err, ErrorMatches, "open .*/missing.pem: no such file or directory")
+
+	c.Assert(os.WriteFile(config.ACME.CARoot, []byte("not a certificate"), 0644), IsNil)
+	_, err = newACMEManager(config)
+	c.Check(err, ErrorMatches, "no PEM certificate found in '.*/missing.pem'")
+}
+
+func (s *ACMESuite) TestCacheDirectory(c *C) {
+	testdata := []struct {
+		Directory, StateDirectory, Expected string
+	}{
+		{"/etc/ath", "/var/lib/ath", "/etc/ath"},
+		{"", "/var/lib/ath", "/var/lib/ath/acme"},
+		{"", "/var/lib/ath:/var/lib/other", "/var/lib/ath/acme"},
+	}
+	for _, d := range testdata {
+		dir, err := acmeCacheDirectory(d.Directory, d.StateDirectory)
+		c.Check(err, IsNil)
+		c.Check(dir, Equals, d.Expected, Commentf("%+v", d))
+	}
+	_, err := acmeCacheDirectory("", "")
+	c.Check(err, ErrorMatches, "--acme.cache-dir is required to store ACME certificates, unless STATE_DIRECTORY is set")
+}
+
+func (s *ACMESuite) TestChainCertificateGetters(c *C) {
+	first := &tls.Certificate{}
+	second := &tls.Certificate{}
+	failing := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return nil, errors.New("host not allowed")
+	}
+	empty := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return nil, nil }
+	returns := func(cert *tls.Certificate) certificateGetter {
+		return func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }
+	}
+
+	cert, err := chainCertificateGetters(returns(first), returns(second))(&tls.ClientHelloInfo{})
+	c.Check(err, IsNil)
+	c.Check(cert == first, Equals, true)
+
+	cert, err = chainCertificateGetters(failing, empty, returns(second))(&tls.ClientHelloInfo{})
+	c.Check(err, IsNil)
+	c.Check(cert == second, Equals, true)
+
+	_, err = chainCertificateGetters(failing, failing)(&tls.ClientHelloInfo{})
+	c.Check(err, ErrorMatches, "host not allowed\nhost not allowed")
+}
+
+// TestPebble obtains a certificate from a local ACME test server. It
+// requires a pebble instance started with PEBBLE_VA_ALWAYS_VALID=1,
+// e.g.:
+//
+//	ATH_PEBBLE_DIRECTORY=https://localhost:14000/dir \
+//	ATH_PEBBLE_CA=test/certs/pebble.minica.pem go test
+func (s *ACMESuite) TestPebble(c *C) {
+	directory := os.Getenv("ATH_PEBBLE_DIRECTORY")
+	if len(directory) == 0 {
+		c.Skip("ATH_PEBBLE_DIRECTORY is not set")
+	}
+
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{
+		"--acme.domain", "example.com",
+		"--acme.directory", directory,
+		"--acme.ca-root", os.Getenv("ATH_PEBBLE_CA"),
+		"--acme.cache-dir", c.MkDir(),
+		"--acme.accept-tos",
+	})
+	c.Assert(err, IsNil)
+	manager, err := newACMEManager(config)
+	c.Assert(err, IsNil)
+
+	cert, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	c.Assert(err, IsNil)
+	c.Check(cert.Leaf.DNSNames, DeepEquals, []string{"example.com"})
+
+	entries, err := os.ReadDir(config.ACME.CacheDirectory)
+	c.Assert(err, IsNil)
+	c.Check(len(entries) > 0, Equals, true)
+}
@@ -0,0 +1,103 @@
+package ath
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// parseBaseHref returns the path prefix of the application for a
+// --base-href value, without trailing slash.
+func parseBaseHref(baseHref string) (string, error) {
+	if strings.HasPrefix(baseHref, "/") == false || strings.ContainsAny(baseHref, "?#") {
+		return "", fmt.Errorf("invalid base href '%s', expected an absolute path such as '/admin/'", baseHref)
+	}
+	res := path.Clean(baseHref)
+	if res == "/" {
+		return "", nil
+	}
+	return res, nil
+}
+
+var baseTagRx = regexp.MustCompile(`(?i)<base\b[^>]*>`)
+
+// validateBaseHref checks that the <base href> of the index of the
+// application, or of each of its locales, matches basePath.
+func validateBaseHref(root, basePath string, locales *localeRouter) error {
+	indexes := map[string]string{"/index.html": basePath + "/"}
+	if locales != nil {
+		indexes = make(map[string]string)
+		for _, locale := range locales.locales {
+			indexes["/"+locale+"/index.html"] = basePath + "/" + locale + "/"
+		}
+	}
+
+	for target, expected := range indexes {
+		content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(target)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		tag := baseTagRx.FindString(string(content))
+		if len(tag) == 0 {
+			zap.L().Warn("no <base href> to validate --base-href against",
+				zap.String("target", target))
+			continue
+		}
+		href := parseHTMLAttributes(tag)["href"]
+		if href != expected {
+			return fmt.Errorf("'%s' has <base href=\"%s\">, expected \"%s\" from --base-href", target, href, expected)
+		}
+	}
+	return nil
+}
+
+// WithBaseHref serves the application under basePath. If strip is
+// true, basePath is removed from request paths, which may also not
+// have it, and routes are not prefixed by it.
+func WithBaseHref(basePath string, strip bool) HandlerOption {
+	return func(h *Handler) {
+		h.basePath = basePath
+		h.stripBaseHref = strip
+	}
+}
+
+// appPath returns the path p relative to the application base path,
+// or false if it is outside of it. With stripBaseHref, paths without
+// the base path are also accepted, as sent by reverse proxies that
+// already strip it.
+func (h *Handler) appPath(p string) (string, bool) {
+	if len(h.basePath) == 0 {
+		return p, true
+	}
+	if strings.HasPrefix(p, h.basePath+"/") == true {
+		return strings.TrimPrefix(p, h.basePath), true
+	}
+	if h.stripBaseHref == true && p != h.basePath {
+		return p, true
+	}
+	return "", false
+}
+
+// target returns the route target for the application path p.
+func (h *Handler) target(p string) string {
+	if h.stripBaseHref == true {
+		return p
+	}
+	return h.basePath + p
+}
+
+func withPath(req *http.Request, p string) *http.Request {
+	res := req.Clone(req.Context())
+	res.URL.Path = p
+	res.URL.RawPath = ""
+	return res
+}
@@ -0,0 +1,129 @@
+package ath
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type BaseHrefSuite struct{}
+
+var _ = Suite(&BaseHrefSuite{})
+
+func (s *BaseHrefSuite) TestParse(c *C) {
+	testdata := []struct {
+		Value, Expected, Error string
+	}{
+		{"/", "", ""},
+		{"/admin/", "/admin", ""},
+		{"/admin", "/admin", ""},
+		{"/apps//portal/", "/apps/portal", ""},
+		{"admin/", "", "invalid base href 'admin/', expected an absolute path such as '/admin/'"},
+		{"/admin/?x", "", "invalid base href '/admin/\\?x', .*"},
+	}
+	for _, d := range testdata {
+		res, err := parseBaseHref(d.Value)
+		if len(d.Error) > 0 {
+			c.Check(err, ErrorMatches, d.Error)
+			continue
+		}
+		c.Check(err, IsNil)
+		c.Check(res, Equals, d.Expected)
+	}
+}
+
+func writeBaseHrefApp(c *C, baseHref string) string {
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "index.html"),
+		[]byte(`<html><head><base href="`+baseHref+`"></head><body></body></html>`), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "main.0123456789abcdef.js"), []byte("main"), 0644), IsNil)
+	return dir
+}
+
+func (s *BaseHrefSuite) TestValidate(c *C) {
+	dir := writeBaseHrefApp(c, "/admin/")
+	c.Check(validateBaseHref(dir, "/admin", nil), IsNil)
+	c.Check(validateBaseHref(dir, "", nil), ErrorMatches,
+		`'/index.html' has <base href="/admin/">, expected "/" from --base-href`)
+
+	localized := writeLocalizedApp(c)
+	locales := &localeRouter{locales: []string{"en-US", "fr"}}
+	c.Check(validateBaseHref(localized, "", locales), IsNil)
+	c.Check(validateBaseHref(localized, "/portal", locales), ErrorMatches,
+		`'/(en-US|fr)/index.html' has <base href="/(en-US|fr)/">, expected "/portal/(en-US|fr)/" from --base-href`)
+}
+
+func (s *BaseHrefSuite) TestRouting(c *C) {
+	dir := writeBaseHrefApp(c, "/admin/")
+
+	for _, strip := range []bool{false, true} {
+		args := []string{dir, "--base-href", "/admin/"}
+		if strip == true {
+			args = append(args, "--strip-base-href")
+		}
+		var config Config
+		_, err := flags.ParseArgs(&config, args)
+		c.Assert(err, IsNil)
+		routes, err := BuildRoutes(config)
+		c.Assert(err, IsNil)
+		if strip == true {
+			c.Check(routes["/index.html"], NotNil)
+		} else {
+			c.Check(routes["/admin/index.html"], NotNil)
+			c.Check(routes["/admin/main.0123456789abcdef.js"], NotNil)
+		}
+
+		h := NewHandler(routes, WithBaseHref("/admin", strip))
+		type routingCase struct {
+			Target   string
+			Status   int
+			Location string
+			Body     string
+		}
+		testdata := []routingCase{
+			{Target: "/admin/", Status: http.StatusOK, Body: "<html>.*"},
+			{Target: "/admin/users/1", Status: http.StatusOK, Body: "<html>.*"},
+			{Target: "/admin/main.0123456789abcdef.js", Status: http.StatusOK, Body: "main"},
+			{Target: "/admin?x=1", Status: http.StatusMovedPermanently, Location: "/admin/?x=1"},
+		}
+		if strip == true {
+			// the base path was already stripped by a reverse proxy.
+			testdata = append(testdata, []routingCase{
+				{Target: "/", Status: http.StatusOK, Body: "<html>.*"},
+				{Target: "/users/1", Status: http.StatusOK, Body: "<html>.*"},
+				{Target: "/main.0123456789abcdef.js", Status: http.StatusOK, Body: "main"},
+			}...)
+		} else {
+			testdata = append(testdata, []routingCase{
+				{Target: "/", Status: http.StatusNotFound},
+				{Target: "/portal/users", Status: http.StatusNotFound},
+				{Target: "/administration", Status: http.StatusNotFound},
+			}...)
+		}
+		for _, d := range testdata {
+			comment := Commentf("strip: %v, %+v", strip, d)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", d.Target, nil))
+			c.Check(w.Code, Equals, d.Status, comment)
+			if len(d.Location) > 0 {
+				c.Check(w.Header().Get("Location"), Equals, d.Location, comment)
+			}
+			if len(d.Body) > 0 {
+				c.Check(w.Body.String(), Matches, d.Body, comment)
+			}
+		}
+	}
+}
+
+func (s *BaseHrefSuite) TestMismatch(c *C) {
+	dir := writeBaseHrefApp(c, "/")
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{dir, "--base-href", "/admin/"})
+	c.Assert(err, IsNil)
+	_, err = BuildRoutes(config)
+	c.Check(err, ErrorMatches, `'/index.html' has <base href="/">, expected "/admin/" from --base-href`)
+}
@@ -11,26 +11,81 @@ import (
 	"strings"
 	"text/template"
 
+	"go.uber.org/zap"
 	"golang.org/x/exp/slices"
 )
 
 type routeBuilder struct {
 	root               string
 	config             Config
-	template           *template.Template
+	csp                CSPConfig
 	enabledCompression []Compression
 	allowedCompression map[string]bool
 	permanent, sized   Cache
+	integrity          *integrityRewriter
+	nonces             nonceSource
+	locales            *localeRouter
+	// basePath prefixes all targets.
+	basePath string
 }
 
 func BuildRoutes(config Config) (map[string]Route, error) {
-	policy := strings.ReplaceAll(config.CSP.Policy, "CSP_NONCE", "{{.Nonce}}")
-	tmpl, err := template.New("CSP").Parse(policy)
+	builder, err := newRouteBuilder(config, nil)
 	if err != nil {
 		return nil, err
 	}
+	return builder.build()
+}
+
+// newRouteBuilder returns a builder for the application described by
+// config, whose caches share budget, if not nil.
+func newRouteBuilder(config Config, budget *memoryBudget) (*routeBuilder, error) {
+	var csp CSPConfig
+	var nonces nonceSource
+	if config.CSP.Disable == false {
+		var err error
+		csp, err = loadCSPConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		nonces, err = newNonceSource(config.CSP.NonceLength, config.CSP.NoncePool)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	sized := NewCache(int64(config.ServerCache.MaxMemorySize))
+	locales, err := loadLocales(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CSP.Disable == false && csp.requiresTrustedTypes() == true {
+		supported, err := bundleUsesTrustedTypes(config.Args.Directory, locales)
+		if supported == false {
+			zap.L().Warn("main bundle does not use Trusted Types, not enforcing them",
+				zap.String("directory", config.Args.Directory),
+				zap.Error(err))
+			csp = csp.withoutTrustedTypes()
+		}
+	}
+
+	basePath, err := parseBaseHref(config.BaseHref)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateBaseHref(config.Args.Directory, basePath, locales); err != nil {
+		return nil, err
+	}
+	var integrity *integrityRewriter
+	if config.Integrity.Enable == true {
+		// HTML files reference the base path even if it is stripped.
+		integrity = newIntegrityRewriter(config.Args.Directory, basePath, config.Integrity.CrossOrigin)
+	}
+	if config.StripBaseHref == true {
+		basePath = ""
+	}
+
+	sized := newBudgetedCache(int64(config.ServerCache.MaxMemorySize), budget)
 	var permanent Cache
 	if config.ServerCache.RootFileInLRU == true {
 		permanent = sized
@@ -38,16 +93,32 @@ func BuildRoutes(config Config) (map[string]Route, error) {
 		permanent = NewCache(-1)
 	}
 
-	return (&routeBuilder{
+	return &routeBuilder{
 		root:               config.Args.Directory,
 		config:             config,
-		template:           tmpl,
+		csp:                csp,
 		enabledCompression: config.EnabledCompressions(),
 		allowedCompression: config.AllowedCompressions(),
 		permanent:          permanent,
 		sized:              sized,
-	}).buildRoutes()
+		integrity:          integrity,
+		nonces:             nonces,
+		locales:            locales,
+		basePath:           basePath,
+	}, nil
+}
 
+// build returns the routes of the application and of its previous
+// bundles.
+func (b *routeBuilder) build() (map[string]Route, error) {
+	routes, err := b.buildRoutes()
+	if err != nil {
+		return nil, err
+	}
+	if err := b.addPreviousBundles(routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
 }
 
 func (b *routeBuilder) buildRoutes() (map[string]Route, error) {
@@ -66,7 +137,7 @@ func (b *routeBuilder) buildRoutes() (map[string]Route, error) {
 			if err != nil {
 				return err
 			}
-			res[target] = route
+			res[b.basePath+target] = route
 			return nil
 		})
 	return res, err
@@ -77,9 +148,10 @@ var ErrNonNonceable = errors.New("route is not nonceable")
 func (b *routeBuilder) buildRoute(path string, d fs.DirEntry) (string, Route, error) {
 	target := buildTarget(b.root, path)
 
+	// each locale has its own nonced files.
 	if b.config.CSP.Disable == false &&
-		slices.Contains(b.config.CSP.NoncedPath, target) == true {
-		nonced, err := b.buildNoncedRoute(path)
+		slices.Contains(b.config.CSP.NoncedPath, b.locales.unlocalized(target)) == true {
+		nonced, err := b.buildNoncedRoute(target, path)
 		if err == nil {
 			return target, nonced, nil
 		}
@@ -99,7 +171,7 @@ func (b *routeBuilder) buildRoute(path string, d fs.DirEntry) (string, Route, er
 
 var ngCspNoncedRx = regexp.MustCompile(`ng_csp_nonced(="[^"]*")?`)
 
-func (b *routeBuilder) buildNoncedRoute(path string) (Route, error) {
+func (b *routeBuilder) buildNoncedRoute(target, path string) (Route, error) {
 	content_, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("open '%s': %w", path, err)
@@ -110,17 +182,50 @@ func (b *routeBuilder) buildNoncedRoute(path string) (Route, error) {
 		return nil, ErrNonNonceable
 	}
 
-	templ, err := b.template.Clone()
+	templ, err := template.New("CSP").Parse(b.csp.PolicyFor(b.locales.unlocalized(target)).Template())
 	if err != nil {
 		return nil, err
 	}
 
-	templ, err = templ.New("content").Parse(ngCspNoncedRx.ReplaceAllString(content,
-		"ngCspNonce=\"{{.Nonce}}\""))
+	headers := b.csp.HeaderNames()
+	for _, name := range headers {
+		value := strings.ReplaceAll(b.csp.Headers[name], CSPNoncePlaceholder, "{{.Nonce}}")
+		_, err = templ.New(noncedHeaderTemplate(name)).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("header '%s': %w", name, err)
+		}
+	}
+
+	content, err = b.rewriteIntegrity(path, content)
+	if err != nil {
+		return nil, err
+	}
+
+	content = ngCspNoncedRx.ReplaceAllString(content, "ngCspNonce=\"{{.Nonce}}\"")
+	if b.csp.MetaTag == true {
+		content, err = injectNonceMetaTag(content)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", path, err)
+		}
+	}
+
+	templ, err = templ.New("content").Parse(content)
 	if err != nil {
 		return nil, err
 	}
 
+	page, err := newSplicedPage(templ, headers)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %w", path, err)
+	}
+	enabledCompression := b.enabledCompression
+	if page != nil {
+		enabledCompression = spliceableFirst(enabledCompression)
+	} else {
+		zap.L().Info("nonced file uses template actions, it will be rendered on each request",
+			zap.String("path", path))
+	}
+
 	name := filepath.Base(path)
 	mime := mime.TypeByExtension(filepath.Ext(name))
 
@@ -128,12 +233,27 @@ func (b *routeBuilder) buildNoncedRoute(path string) (Route, error) {
 		route: route{
 			name:               name,
 			mime:               mime,
-			enabledCompression: b.enabledCompression,
+			enabledCompression: enabledCompression,
 		},
 		template: templ,
+		headers:  headers,
+		page:     page,
+		nonces:   b.nonces,
 	}, nil
 }
 
+var headTagRx = regexp.MustCompile(`(?i)<head(\s[^>]*)?>`)
+
+func injectNonceMetaTag(content string) (string, error) {
+	loc := headTagRx.FindStringIndex(content)
+	if loc == nil {
+		return "", errors.New("no <head> tag to inject the nonce <meta> tag")
+	}
+	return content[:loc[1]] +
+		`<meta property="csp-nonce" nonce="{{.Nonce}}">` +
+		content[loc[1]:], nil
+}
+
 func (b *routeBuilder) buildStaticRoute(path string, d fs.DirEntry) (Route, error) {
 	name := filepath.Base(path)
 	mime := mime.TypeByExtension(filepath.Ext(name))
@@ -143,6 +263,19 @@ func (b *routeBuilder) buildStaticRoute(path string, d fs.DirEntry) (Route, erro
 		return nil, err
 	}
 
+	var content []byte
+	if b.needsIntegrity(path) == true {
+		original, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("open '%s': %w", path, err)
+		}
+		rewritten, err := b.rewriteIntegrity(path, string(original))
+		if err != nil {
+			return nil, err
+		}
+		content = []byte(rewritten)
+	}
+
 	return StaticRoute{
 		route: route{
 			name:               name,
@@ -150,14 +283,35 @@ func (b *routeBuilder) buildStaticRoute(path string, d fs.DirEntry) (Route, erro
 			enabledCompression: b.getCompression(fileinfo),
 		},
 		filepath:     path,
+		content:      content,
 		modtime:      fileinfo.ModTime(),
 		cache:        b.getCache(path),
 		cacheControl: b.getCacheControl(path),
 	}, nil
 }
 
+func (b *routeBuilder) needsIntegrity(path string) bool {
+	return b.integrity != nil && b.inRoot(path) && filepath.Ext(path) == ".html"
+}
+
+func (b *routeBuilder) rewriteIntegrity(path, content string) (string, error) {
+	if b.needsIntegrity(path) == false {
+		return content, nil
+	}
+	return b.integrity.Rewrite(buildTarget(b.root, path), content)
+}
+
+// inRoot returns true for files at the root of the application, or
+// of one of its locales.
 func (b *routeBuilder) inRoot(path string) bool {
-	return filepath.Dir(path) == filepath.Clean(b.root)
+	dir := filepath.Dir(path)
+	if dir == filepath.Clean(b.root) {
+		return true
+	}
+	if b.locales == nil || filepath.Dir(dir) != filepath.Clean(b.root) {
+		return false
+	}
+	return slices.Contains(b.locales.locales, filepath.Base(dir))
 }
 
 func (b *routeBuilder) getCache(path string) Cache {
@@ -2,7 +2,9 @@ package ath
 
 import (
 	"bytes"
+	"io/ioutil"
 	"net/http"
+	"path/filepath"
 
 	"github.com/jessevdk/go-flags"
 	. "gopkg.in/check.v1"
@@ -86,3 +88,95 @@ func (s *BuildRoutesSuite) TestNoncedApplication(c *C) {
 	})
 
 }
+
+func (s *BuildRoutesSuite) TestTrustedTypesNotEnforcedWithoutSupport(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"utest-data/utest-app-nonced", "--csp.trusted-types"})
+	c.Assert(err, IsNil)
+	routes, err := BuildRoutes(config)
+	c.Assert(err, IsNil)
+
+	w := NewMockResponseWritter()
+	req, err := http.NewRequest("GET", "/", bytes.NewBuffer(nil))
+	c.Assert(err, IsNil)
+	routes["/index.html"].ServeHTTP(w, req)
+
+	c.Check(w.header.Get("Content-Security-Policy"), Matches,
+		"default-src 'self'; .*; trusted-types angular angular#bundler")
+
+	// also when the directive is written in the policy.
+	path := filepath.Join(c.MkDir(), "csp.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`{
+  "policy": "default-src 'self'; require-trusted-types-for 'script'",
+  "routes": { "/index.html": "require-trusted-types-for 'script'" }
+}`), 0644), IsNil)
+	config = Config{}
+	_, err = flags.ParseArgs(&config, []string{"utest-data/utest-app-nonced", "--csp.config", path})
+	c.Assert(err, IsNil)
+	routes, err = BuildRoutes(config)
+	c.Assert(err, IsNil)
+
+	w = NewMockResponseWritter()
+	routes["/index.html"].ServeHTTP(w, req)
+	c.Check(w.header.Get("Content-Security-Policy"), Matches, "default-src 'self'.*")
+	c.Check(w.header.Get("Content-Security-Policy"), Not(Matches), ".*require-trusted-types-for.*")
+}
+
+func (s *BuildRoutesSuite) TestNoncedHeadersAndMetaTag(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"utest-data/utest-app-nonced",
+		"--csp.meta-tag",
+		"--csp.header", "link: </styles.ef46db3751d8e999.css>; rel=preload; as=style; nonce=CSP_NONCE",
+	})
+	c.Assert(err, IsNil)
+	routes, err := BuildRoutes(config)
+	c.Assert(err, IsNil)
+
+	w := NewMockResponseWritter()
+	req, err := http.NewRequest("GET", "/", bytes.NewBuffer(nil))
+	c.Assert(err, IsNil)
+	routes["/index.html"].ServeHTTP(w, req)
+
+	c.Check(w.header.Get("Link"), Matches,
+		"</styles.ef46db3751d8e999.css>; rel=preload; as=style; nonce=[[:alnum:]_-]+")
+	c.Check(string(w.buffer.Bytes()), Matches,
+		`(?s).*<head><meta property="csp-nonce" nonce="[[:alnum:]_-]+">\n  <meta charset.*`)
+
+	config = Config{}
+	_, err = flags.ParseArgs(&config, []string{"utest-data/utest-app-nonced",
+		"--csp.header", "Link </styles.css>",
+	})
+	c.Assert(err, IsNil)
+	_, err = BuildRoutes(config)
+	c.Check(err, ErrorMatches, "invalid header 'Link </styles.css>': should be 'Name: value'")
+}
+
+func (s *BuildRoutesSuite) TestSubresourceIntegrity(c *C) {
+	for _, app := range []string{"utest-data/utest-app", "utest-data/utest-app-nonced"} {
+		comment := Commentf("application %s", app)
+		var config Config
+		_, err := flags.ParseArgs(&config, []string{app, "--sri.enable"})
+		c.Assert(err, IsNil, comment)
+		routes, err := BuildRoutes(config)
+		c.Assert(err, IsNil, comment)
+
+		w := NewMockResponseWritter()
+		req, err := http.NewRequest("GET", "/", bytes.NewBuffer(nil))
+		c.Assert(err, IsNil)
+		routes["/index.html"].ServeHTTP(w, req)
+
+		c.Check(string(w.buffer.Bytes()), Matches,
+			`(?s).*<link rel="stylesheet" href="styles.ef46db3751d8e999.css" integrity="`+emptySHA384+`" crossorigin="anonymous">.*`+
+				`<script src="main.d9c155841b368d1f.js" type="module" integrity="sha384-[[:alnum:]+/]+" crossorigin="anonymous"></script>.*`,
+			comment)
+	}
+
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "index.html"),
+		[]byte(`<html><script src="main.js"></script></html>`), 0644), IsNil)
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{dir, "--sri.enable"})
+	c.Assert(err, IsNil)
+	_, err = BuildRoutes(config)
+	c.Check(err, ErrorMatches, "'/index.html' references 'main.js': open .*: no such file or directory")
+}
@@ -3,6 +3,7 @@ package ath
 import (
 	"container/list"
 	"sync"
+	"sync/atomic"
 )
 
 type Creator func() ([]byte, error)
@@ -19,21 +20,94 @@ type cacheElement struct {
 	value   []byte
 }
 
+// memoryBudget bounds the total size of several sized caches. When a
+// cache storing a new value exceeds the budget, the least recent
+// values of the largest cache are evicted, so that a cache filled
+// first does not starve the others. Unsized caches can not be
+// evicted, so they are kept out of the budget, otherwise they could
+// leave no room for sized caches.
+type memoryBudget struct {
+	max  int64
+	used atomic.Int64
+
+	mx     sync.Mutex
+	caches []*lruCache
+}
+
+func newMemoryBudget(max int64) *memoryBudget {
+	return &memoryBudget{max: max}
+}
+
+func (b *memoryBudget) exceeded() bool {
+	return b != nil && b.max > 0 && b.used.Load() > b.max
+}
+
+func (b *memoryBudget) add(size int64) {
+	if b != nil {
+		b.used.Add(size)
+	}
+}
+
+func (b *memoryBudget) register(c *lruCache) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.caches = append(b.caches, c)
+}
+
+// largest returns the cache holding the most.
+func (b *memoryBudget) largest() *lruCache {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	var res *lruCache
+	var size int64
+	for _, c := range b.caches {
+		if s := c.Size(); res == nil || s > size {
+			res, size = c, s
+		}
+	}
+	return res
+}
+
+// enforce evicts values until the budget is honored. It must be
+// called without holding any cache lock, as it locks the evicted
+// caches.
+func (b *memoryBudget) enforce() {
+	for b.exceeded() == true {
+		c := b.largest()
+		if c == nil || c.evictOne() == false {
+			return
+		}
+	}
+}
+
 type lruCache struct {
 	mx      sync.RWMutex
 	data    map[string]*cacheElement
 	list    *list.List
 	size    int64
 	maxSize int64
+	budget  *memoryBudget
 }
 
 func NewCache(maxSize int64) Cache {
-	return &lruCache{
+	return newBudgetedCache(maxSize, nil)
+}
+
+func newBudgetedCache(maxSize int64, budget *memoryBudget) Cache {
+	if maxSize <= 0 {
+		budget = nil
+	}
+	res := &lruCache{
 		data:    make(map[string]*cacheElement),
 		list:    list.New(),
 		size:    0,
 		maxSize: maxSize,
+		budget:  budget,
+	}
+	if budget != nil {
+		budget.register(res)
 	}
+	return res
 }
 
 func (c *lruCache) load(key string) ([]byte, bool) {
@@ -49,11 +123,16 @@ func (c *lruCache) store(key string, value []byte) {
 	if c.maxSize > 0 && int64(cap(value)) > c.maxSize {
 		return
 	}
+	if c.budget != nil && c.budget.max > 0 && int64(cap(value)) > c.budget.max {
+		return
+	}
 
 	defer c.evictLeastRecent()
 
 	if actual, ok := c.data[key]; ok == true {
-		c.size += int64(cap(value) - cap(actual.value))
+		delta := int64(cap(value) - cap(actual.value))
+		c.size += delta
+		c.budget.add(delta)
 		actual.value = value
 		c.list.MoveToFront(actual.element)
 		return
@@ -61,6 +140,7 @@ func (c *lruCache) store(key string, value []byte) {
 	element := &cacheElement{element: c.list.PushFront(key), value: value}
 	c.data[key] = element
 	c.size += int64(cap(value))
+	c.budget.add(int64(cap(value)))
 }
 
 func (c *lruCache) evictLeastRecent() {
@@ -68,21 +148,39 @@ func (c *lruCache) evictLeastRecent() {
 		return
 	}
 
-	for c.size > c.maxSize {
-		back := c.list.Back()
-		key := back.Value.(string)
-		c.list.Remove(back)
+	for c.list.Len() > 0 && c.size > c.maxSize {
+		c.removeBack()
+	}
+}
+
+func (c *lruCache) removeBack() {
+	back := c.list.Back()
+	key := back.Value.(string)
+	c.list.Remove(back)
+
+	stored := c.data[key]
+	c.size -= int64(cap(stored.value))
+	c.budget.add(-int64(cap(stored.value)))
+	delete(c.data, key)
+}
 
-		stored := c.data[key]
-		c.size -= int64(cap(stored.value))
-		delete(c.data, key)
+// evictOne evicts the least recent value, or returns false if the
+// cache is empty.
+func (c *lruCache) evictOne() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.list.Len() == 0 {
+		return false
 	}
+	c.removeBack()
+	return true
 }
 
 func (c *lruCache) Store(key string, value []byte) {
 	c.mx.Lock()
-	defer c.mx.Unlock()
 	c.store(key, value)
+	c.mx.Unlock()
+	c.budget.enforce()
 }
 
 func (c *lruCache) Load(key string) ([]byte, bool) {
@@ -96,6 +194,12 @@ func (c *lruCache) Get(key string, create Creator) ([]byte, error) {
 	if ok == true {
 		return value, nil
 	}
+	value, err := c.create(key, create)
+	c.budget.enforce()
+	return value, err
+}
+
+func (c *lruCache) create(key string, create Creator) ([]byte, error) {
 	c.mx.Lock()
 	defer c.mx.Unlock()
 
@@ -2,6 +2,7 @@ package ath
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 
 	. "gopkg.in/check.v1"
@@ -122,3 +123,64 @@ func (s *CacheSuite) TestGetRaceCondition(c *C) {
 		c.Check(r.Value, HasLen, 1)
 	}
 }
+
+func (s *CacheSuite) TestSharedBudget(c *C) {
+	budget := newMemoryBudget(2 * 1024)
+	a := newBudgetedCache(2*1024, budget)
+	b := newBudgetedCache(8*1024, budget)
+	permanent := newBudgetedCache(-1, budget)
+
+	a.Store("a1", make([]byte, 0, 1024))
+	b.Store("b1", make([]byte, 0, 1024))
+	c.Check(budget.used.Load(), Equals, int64(2*1024))
+
+	// a is within its own size, but evicts as the largest cache.
+	a.Store("a2", make([]byte, 0, 1024))
+	c.Check(hasKey(a, "a1"), Equals, false)
+	c.Check(hasKey(a, "a2"), Equals, true)
+	c.Check(hasKey(b, "b1"), Equals, true)
+	c.Check(budget.used.Load(), Equals, int64(2*1024))
+
+	// values larger than the whole budget are never stored.
+	b.Store("b2", make([]byte, 0, 4*1024))
+	c.Check(hasKey(b, "b2"), Equals, false)
+
+	// unsized caches can not be evicted, and do not use the budget
+	// of sized ones.
+	permanent.Store("root", make([]byte, 0, 4*1024))
+	c.Check(hasKey(permanent, "root"), Equals, true)
+	c.Check(budget.used.Load(), Equals, int64(2*1024))
+	a.Store("a3", make([]byte, 0, 1024))
+	c.Check(hasKey(a, "a3"), Equals, true)
+	c.Check(hasKey(b, "b1"), Equals, true)
+}
+
+func (s *CacheSuite) TestBudgetStarvation(c *C) {
+	budget := newMemoryBudget(4 * 1024)
+	first := newBudgetedCache(8*1024, budget)
+	second := newBudgetedCache(8*1024, budget)
+
+	// the first site fills the budget on startup.
+	for i := 0; i < 4; i++ {
+		first.Store(fmt.Sprintf("first%d", i), make([]byte, 0, 1024))
+	}
+	c.Check(budget.used.Load(), Equals, int64(4*1024))
+
+	// the second site can still cache, evicting from the first.
+	second.Store("second0", make([]byte, 0, 1024))
+	_, err := second.Get("second1", func() ([]byte, error) { return make([]byte, 0, 1024), nil })
+	c.Assert(err, IsNil)
+	c.Check(hasKey(second, "second0"), Equals, true)
+	c.Check(hasKey(second, "second1"), Equals, true)
+	c.Check(hasKey(first, "first0"), Equals, false)
+	c.Check(hasKey(first, "first1"), Equals, false)
+	c.Check(hasKey(first, "first2"), Equals, true)
+	c.Check(budget.used.Load(), Equals, int64(4*1024))
+
+	// caches then share the budget, evicting from the largest.
+	second.Store("second2", make([]byte, 0, 1024))
+	c.Check(first.Size(), Equals, int64(2*1024))
+	c.Check(second.Size(), Equals, int64(2*1024))
+	c.Check(hasKey(second, "second0"), Equals, false)
+	c.Check(hasKey(second, "second2"), Equals, true)
+}
@@ -0,0 +1,60 @@
+package ath
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type clientAuth struct {
+	exempt []string
+}
+
+func WithClientAuth(exempt []string) HandlerOption {
+	return func(h *Handler) {
+		h.clientAuth = &clientAuth{exempt: exempt}
+	}
+}
+
+func (a *clientAuth) required(p string) bool {
+	if a == nil {
+		return false
+	}
+	p = cleanPath(p)
+	for _, pattern := range a.exempt {
+		if matchGlob(pattern, p) == true {
+			return false
+		}
+	}
+	return true
+}
+
+// clientSubject returns the subject of the verified client
+// certificate, or an empty string.
+func clientSubject(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.String()
+}
+
+func traceClientSubject(req *http.Request, subject string) {
+	trace.SpanFromContext(req.Context()).SetAttributes(
+		attribute.String("tls.client.subject", subject),
+	)
+}
+
+// configureClientAuth makes config verify client certificates
+// against the CA bundle in caFile. Certificates are only requested,
+// as requirement is enforced per path by the Handler.
+func configureClientAuth(config *tls.Config, caFile string) error {
+	roots, err := loadCertPool(caFile)
+	if err != nil {
+		return err
+	}
+	config.ClientCAs = roots
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
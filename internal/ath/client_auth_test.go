@@ -0,0 +1,145 @@
+package ath
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	. "gopkg.in/check.v1"
+)
+
+type ClientAuthSuite struct {
+	dir     string
+	logs    *observer.ObservedLogs
+	restore func()
+}
+
+var _ = Suite(&ClientAuthSuite{})
+
+func (s *ClientAuthSuite) SetUpSuite(c *C) {
+	s.dir = c.MkDir()
+	writeTestCertificate(c, filepath.Join(s.dir, "server.pem"), filepath.Join(s.dir, "server.key"), "localhost")
+	writeTestCertificate(c, filepath.Join(s.dir, "client.pem"), filepath.Join(s.dir, "client.key"), "admin")
+	writeTestCertificate(c, filepath.Join(s.dir, "other.pem"), filepath.Join(s.dir, "other.key"), "intruder")
+}
+
+func (s *ClientAuthSuite) SetUpTest(c *C) {
+	var core zapcore.Core
+	core, s.logs = observer.New(zapcore.InfoLevel)
+	log, err := zap.NewProduction(zap.WrapCore(func(zapcore.Core) zapcore.Core {
+		return core
+	}))
+	c.Assert(err, IsNil)
+	s.restore = zap.ReplaceGlobals(log)
+}
+
+func (s *ClientAuthSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func (s *ClientAuthSuite) TestRequired(c *C) {
+	var auth *clientAuth
+	c.Check(auth.required("/index.html"), Equals, false)
+	auth = &clientAuth{exempt: []string{"/healthz", "/public/**"}}
+	c.Check(auth.required("/index.html"), Equals, true)
+	c.Check(auth.required("/healthz"), Equals, false)
+	c.Check(auth.required("/public/logo.svg"), Equals, false)
+	c.Check(auth.required("/public/../index.html"), Equals, true)
+	c.Check(auth.required("/public/./../admin/"), Equals, true)
+	c.Check(auth.required("//public/logo.svg"), Equals, false)
+}
+
+func (s *ClientAuthSuite) client(c *C, name string) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	if len(name) > 0 {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(s.dir, name+".pem"), filepath.Join(s.dir, name+".key"))
+		c.Assert(err, IsNil)
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: transport}
+}
+
+func (s *ClientAuthSuite) TestMutualTLS(c *C) {
+	store, err := newCertificateStore(filepath.Join(s.dir, "server.pem"), filepath.Join(s.dir, "server.key"), "")
+	c.Assert(err, IsNil)
+	tlsConfig := newTLSConfig(store.GetCertificate)
+	c.Assert(configureClientAuth(tlsConfig, filepath.Join(s.dir, "client.pem")), IsNil)
+
+	handler := NewHandler(map[string]Route{
+		"/healthz": StaticRoute{
+			route:    route{"healthz", "text/plain", nil},
+			filepath: filepath.Join(s.dir, "client.pem"),
+			cache:    NewCache(-1),
+		},
+	}, WithClientAuth([]string{"/healthz"}))
+
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = tlsConfig
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := s.client(c, "").Get(server.URL + "/admin")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusForbidden)
+
+	resp, err = s.client(c, "").Get(server.URL + "/healthz")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	// not normalized by the client, and not exempted.
+	req, err := http.NewRequest("GET", server.URL+"/healthz/../admin", nil)
+	c.Assert(err, IsNil)
+	req.URL.Opaque = "/healthz/../admin"
+	resp, err = s.client(c, "").Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusForbidden)
+
+	resp, err = s.client(c, "client").Get(server.URL + "/admin")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	// authorized, but no such route.
+	c.Check(resp.StatusCode, Equals, http.StatusNotFound)
+
+	// the client does not send a certificate not issued by the
+	// server's CAs.
+	resp, err = s.client(c, "other").Get(server.URL + "/admin")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusForbidden)
+
+	logs := s.logs.FilterMessage("request").All()
+	c.Assert(logs, HasLen, 5)
+	c.Check(logs[0].ContextMap()["status"], Equals, int64(http.StatusForbidden))
+	c.Check(logs[0].ContextMap()["client"], IsNil)
+	c.Check(logs[2].ContextMap()["URL"], Equals, "/healthz/../admin")
+	c.Check(logs[2].ContextMap()["status"], Equals, int64(http.StatusForbidden))
+	c.Check(logs[3].ContextMap()["client"], Equals, "CN=admin")
+}
+
+func (s *ClientAuthSuite) TestConfigureClientAuth(c *C) {
+	config := &tls.Config{}
+	err := configureClientAuth(config, filepath.Join(s.dir, "missing.pem"))
+	c.Check(err, ErrorMatches, "open .*: no such file or directory")
+
+	c.Assert(os.WriteFile(filepath.Join(s.dir, "empty.pem"), nil, 0644), IsNil)
+	err = configureClientAuth(config, filepath.Join(s.dir, "empty.pem"))
+	c.Check(err, ErrorMatches, "no PEM certificate found in '.*'")
+
+	c.Assert(configureClientAuth(config, filepath.Join(s.dir, "client.pem")), IsNil)
+	c.Check(config.ClientAuth, Equals, tls.VerifyClientCertIfGiven)
+	c.Check(config.ClientCAs.Equal(x509.NewCertPool()), Equals, false)
+}
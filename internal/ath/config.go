@@ -1,8 +1,11 @@
 package ath
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"math"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -11,6 +14,22 @@ import (
 
 type ByteSize int64
 
+// Duration is a time.Duration parsed from JSON strings such as "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string such as \"30s\"", data)
+	}
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
 var prefixes = []string{"", "k", "M", "G", "T"}
 
 func (s ByteSize) String() string {
@@ -55,10 +74,96 @@ func (s *ByteSize) UnmarshalFlag(value string) error {
 	return fmt.Errorf("invalid suffix '%s' in '%s'", m[0][2], value)
 }
 
+// UnmarshalJSON accepts either a number of bytes or a string in the
+// command line format, e.g. "20M".
+func (s *ByteSize) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		return s.UnmarshalFlag(value)
+	}
+	var v int64
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("invalid size %s", data)
+	}
+	*s = ByteSize(v)
+	return nil
+}
+
 type Config struct {
-	Address string `short:"a" long:"address" description:"address to listen to" default:"0.0.0.0"`
-	Port    int    `short:"p" long:"port" description:"port to listen on" default:"80"`
-	Verbose []bool `short:"v" long:"verbose" description:"Enable verbose logging for each request"`
+	Address string   `short:"a" long:"address" description:"address to listen to" default:"0.0.0.0"`
+	Port    int      `short:"p" long:"port" description:"port to listen on" default:"80"`
+	Listen  []string `short:"l" long:"listen" description:"address to listen on, as 'host:port', 'unix:/path/to/socket', or 'systemd[:name]' for sockets passed by systemd socket activation. Can be repeated, replaces --address and --port"`
+	Verbose []bool   `short:"v" long:"verbose" description:"Enable verbose logging for each request"`
+
+	Sites string `long:"sites" description:"JSON file describing several applications to serve from this process, replaces the directory argument"`
+
+	Mount  []MountConfig `long:"mount" description:"forward requests under a path to an upstream server, as '<path>=<upstream URL>', e.g. '/api/=http://localhost:8080'. Can be repeated"`
+	Mounts string        `long:"mounts" description:"JSON file of reverse proxy mounts, with path stripping, header rewriting and timeouts"`
+
+	Rules string `long:"rules" description:"JSON file of redirect and rewrite rules, evaluated before routing"`
+
+	BaseHref      string `long:"base-href" description:"path under which the application is served, e.g. '/admin/'. Must match the <base href> of index.html" default:"/"`
+	StripBaseHref bool   `long:"strip-base-href" description:"remove the base href from request paths, instead of prefixing routes with it"`
+
+	Server struct {
+		ReadHeaderTimeout time.Duration `long:"read-header-timeout" description:"time allowed to read request headers, 0 to disable" default:"10s"`
+		ReadTimeout       time.Duration `long:"read-timeout" description:"time allowed to read a whole request, 0 to disable" default:"30s"`
+		WriteTimeout      time.Duration `long:"write-timeout" description:"time allowed to write a response, 0 to disable" default:"60s"`
+		IdleTimeout       time.Duration `long:"idle-timeout" description:"time to keep idle keep-alive connections open, 0 to disable" default:"120s"`
+		MaxHeaderBytes    ByteSize      `long:"max-header-bytes" description:"maximal size of request headers" default:"64k"`
+		MaxConnections    int           `long:"max-connections" description:"maximal number of concurrent connections, 0 for unlimited" default:"4096"`
+	} `group:"server" namespace:"server"`
+
+	RateLimit struct {
+		Nonced     RateLimit `long:"nonced" description:"rate limit per client on nonced files, as '<requests>/<period>[:<burst>]', e.g. '10/s:20'"`
+		Static     RateLimit `long:"static" description:"rate limit per client on unversionned files"`
+		Immutable  RateLimit `long:"immutable" description:"rate limit per client on versionned files"`
+		MaxClients int       `long:"max-clients" description:"maximal number of clients tracked per rate limit, least recent ones are forgotten first" default:"10000"`
+	} `group:"rate-limit" namespace:"rate-limit"`
+
+	Fallback struct {
+		AllowExtensions bool     `long:"allow-extensions" description:"fall back to index.html for unknown paths with the extension of an asset, such as .js or .png, instead of returning 404"`
+		Exclude         []string `long:"exclude" description:"glob of unknown paths returning 404 instead of index.html, e.g. '/assets/**'. Can be repeated"`
+	} `group:"fallback" namespace:"fallback"`
+
+	Unix struct {
+		Mode  string `long:"mode" description:"permissions of unix sockets, in octal" default:"0660"`
+		Owner string `long:"owner" description:"owner of unix sockets, as a name or uid"`
+		Group string `long:"group" description:"group of unix sockets, as a name or gid"`
+	} `group:"unix-socket" namespace:"unix"`
+
+	TLS struct {
+		Cert           string        `long:"cert" description:"TLS certificate file, enables HTTPS"`
+		Key            string        `long:"key" description:"TLS private key file"`
+		SNIDirectory   string        `long:"sni-dir" description:"directory of additional <name>.crt/<name>.key certificates, selected by SNI"`
+		ReloadInterval time.Duration `long:"reload-interval" description:"interval to check certificate files for changes" default:"30s"`
+		HTTPPort       int           `long:"http-port" description:"if set, port of a plain HTTP listener redirecting to HTTPS"`
+
+		ClientCA         string   `long:"client-ca" description:"PEM bundle of CAs to verify client certificates against, enables mutual TLS"`
+		ClientAuthExempt []string `long:"client-auth-exempt" description:"path patterns that do not require a client certificate, e.g. '/healthz'"`
+	} `group:"tls" namespace:"tls"`
+
+	ACME struct {
+		Domains        []string `long:"domain" description:"domain to obtain a certificate for with ACME, enables HTTPS"`
+		Email          string   `long:"email" description:"contact email for the ACME account"`
+		Directory      string   `long:"directory" description:"ACME directory URL" default:"https://acme-v02.api.letsencrypt.org/directory"`
+		CARoot         string   `long:"ca-root" description:"PEM bundle to trust for the ACME directory, e.g. for a local test server"`
+		CacheDirectory string   `long:"cache-dir" description:"directory where ACME account and certificates are stored, defaults to acme in the systemd STATE_DIRECTORY"`
+		AcceptTOS      bool     `long:"accept-tos" description:"accept the ACME CA Terms of Service"`
+	} `group:"acme" namespace:"acme"`
+
+	Proxy struct {
+		Trusted          []string `long:"trusted" description:"IP or CIDR of a trusted reverse proxy, whose Forwarded or X-Forwarded-* headers are used to resolve the client address and scheme. Can be repeated"`
+		Header           string   `long:"header" description:"the one header trusted proxies set to forward the client address, other headers are ignored" choice:"x-forwarded-for" choice:"forwarded" default:"x-forwarded-for"`
+		ForwardedHost    bool     `long:"forwarded-host" description:"use X-Forwarded-Host from trusted proxies as the request host, only if they always overwrite it"`
+		Protocol         bool     `long:"protocol" description:"require PROXY protocol v1/v2 headers on connections from trusted proxies"`
+		ProtocolOptional bool     `long:"protocol-optional" description:"also accept connections from trusted proxies without a PROXY protocol header"`
+	} `group:"proxy" namespace:"proxy"`
+
+	Protocol struct {
+		H2C   bool `long:"h2c" description:"accept HTTP/2 cleartext (h2c) connections when TLS is disabled"`
+		HTTP3 bool `long:"http3" description:"also serve HTTP/3 over QUIC on the TLS port (UDP), advertised with Alt-Svc"`
+	} `group:"protocol" namespace:"protocol"`
 
 	Compression struct {
 		NoGZIP    bool     `long:"no-gzip" description:"disable gzip compression"`
@@ -77,12 +182,57 @@ type Config struct {
 		MaxMemorySize ByteSize `short:"m" long:"max-size" description:"maximal size of the cache in bytes" default:"50M"`
 	} `group:"server-cache" namespace:"server-cache"`
 
+	ErrorPages struct {
+		Directory string `long:"dir" description:"directory of '<status>.html' error pages, instead of the served directory"`
+		Nonced    bool   `long:"nonced" description:"serve error pages with a CSP nonce, like --csp.nonced files"`
+	} `group:"error-pages" namespace:"error-pages"`
+
+	Previous struct {
+		Bundles     []string      `long:"bundle" description:"directory or .tar, .tar.gz, .zip archive of a previous deployment, whose versionned files are still served. Can be repeated, most recent first"`
+		Keep        int           `long:"keep" description:"number of previous bundles to retain, negative for all" default:"1"`
+		GracePeriod time.Duration `long:"grace-period" description:"duration after startup during which previous bundles are served, 0 for ever" default:"24h"`
+		ExtractDir  string        `long:"extract-dir" description:"directory where archives are extracted, reused across restarts (default: <tmp>/angular-to-http)"`
+	} `group:"previous" namespace:"previous"`
+
 	CSP struct {
 		Disable    bool     `long:"nonce-disable" description:"Disable CSP Nonce generation"`
 		NoncedPath []string `short:"O" long:"nonced" description:"list of nonced file" default:"/index.html"`
 		Policy     string   `long:"policy" description:"CSP to use" default:"default-src 'self'; style-src 'self' 'nonce-CSP_NONCE'; script-src 'self' 'nonce-CSP_NONCE'"`
+		ConfigFile string   `long:"config" description:"JSON file describing the CSP policy and per-route overrides, replaces --csp.policy"`
+
+		StrictDynamic        bool     `long:"strict-dynamic" description:"add 'strict-dynamic' to script-src, so lazily loaded chunks are trusted by the nonced bundle"`
+		TrustedTypes         bool     `long:"trusted-types" description:"enforce Trusted Types for scripts, only if the main bundle supports it"`
+		TrustedTypesPolicies []string `long:"trusted-types-policy" description:"allowed Trusted Types policy names" default:"angular" default:"angular#bundler"`
+
+		Headers []string `long:"header" description:"additional header on nonced files, as 'Name: value', where CSP_NONCE is replaced by the nonce"`
+		MetaTag bool     `long:"meta-tag" description:"inject a <meta property=\"csp-nonce\"> tag holding the nonce in nonced files"`
+
+		NonceLength int `long:"nonce-length" description:"number of random bytes in each nonce" default:"32"`
+		NoncePool   int `long:"nonce-pool" description:"if set, number of nonces generated ahead of requests in the background"`
 	} `group:"csp-nonce" namespace:"csp"`
 
+	I18n struct {
+		Locales []string `long:"locale" description:"locale subdirectory of a 'ng build --localize' bundle. Detected automatically if there is no root index.html"`
+		Default string   `long:"default" description:"locale used when none of the client's languages is available, defaults to the first locale"`
+		Cookie  string   `long:"cookie" description:"cookie holding the locale chosen by the user, preferred over Accept-Language" default:"lang"`
+	} `group:"i18n" namespace:"i18n"`
+
+	Integrity struct {
+		Enable      bool   `long:"enable" description:"add integrity attributes to scripts and stylesheets of root HTML files"`
+		CrossOrigin string `long:"crossorigin" description:"crossorigin attribute added along integrity" choice:"anonymous" choice:"use-credentials" default:"anonymous"`
+	} `group:"subresource-integrity" namespace:"sri"`
+
+	SecurityHeaders struct {
+		Preset            string `long:"preset" description:"security headers preset, 'strict' aims at A+ on common header scanners" choice:"none" choice:"default" choice:"strict" default:"default"`
+		HSTS              string `long:"hsts" description:"Strict-Transport-Security value, overrides the preset"`
+		ReferrerPolicy    string `long:"referrer-policy" description:"Referrer-Policy value, overrides the preset"`
+		PermissionsPolicy string `long:"permissions-policy" description:"Permissions-Policy value, overrides the preset"`
+		COOP              string `long:"coop" description:"Cross-Origin-Opener-Policy value, overrides the preset"`
+		COEP              string `long:"coep" description:"Cross-Origin-Embedder-Policy value, overrides the preset"`
+		CORP              string `long:"corp" description:"Cross-Origin-Resource-Policy value, overrides the preset"`
+		ConfigFile        string `long:"config" description:"JSON file with additional headers and per-path overrides"`
+	} `group:"security-headers" namespace:"headers"`
+
 	Otel struct {
 		Endpoint          string `long:"endpoint" description:"Open Telemetry Collectore Endpoint"`
 		ServiceName       string `long:"name" description:"Service name to report" default:"angular-to-http"`
@@ -94,6 +244,10 @@ type Config struct {
 	} `positional-args:"yes"`
 }
 
+func (c *Config) TLSEnabled() bool {
+	return len(c.TLS.Cert) > 0 || len(c.TLS.SNIDirectory) > 0 || len(c.ACME.Domains) > 0
+}
+
 func (c *Config) EnabledCompressions() []Compression {
 	//TODO: should not be recomputed but done only once
 	res := make([]Compression, 0, 3)
@@ -116,3 +270,16 @@ func (c *Config) AllowedCompressions() map[string]bool {
 	}
 	return res
 }
+
+func loadJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("parsing '%s': %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,506 @@
+package ath
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const CSPNoncePlaceholder = "CSP_NONCE"
+
+type CSPDirective struct {
+	Name    string
+	Sources []string
+}
+
+type CSPPolicy []CSPDirective
+
+type directiveKind int
+
+const (
+	sourceListDirective directiveKind = iota
+	noValueDirective
+	tokenListDirective
+	requireTrustedTypesDirective
+	trustedTypesDirective
+)
+
+var cspDirectives = map[string]directiveKind{
+	"default-src":               sourceListDirective,
+	"child-src":                 sourceListDirective,
+	"connect-src":               sourceListDirective,
+	"font-src":                  sourceListDirective,
+	"frame-src":                 sourceListDirective,
+	"img-src":                   sourceListDirective,
+	"manifest-src":              sourceListDirective,
+	"media-src":                 sourceListDirective,
+	"object-src":                sourceListDirective,
+	"prefetch-src":              sourceListDirective,
+	"script-src":                sourceListDirective,
+	"script-src-elem":           sourceListDirective,
+	"script-src-attr":           sourceListDirective,
+	"style-src":                 sourceListDirective,
+	"style-src-elem":            sourceListDirective,
+	"style-src-attr":            sourceListDirective,
+	"worker-src":                sourceListDirective,
+	"base-uri":                  sourceListDirective,
+	"form-action":               sourceListDirective,
+	"frame-ancestors":           sourceListDirective,
+	"upgrade-insecure-requests": noValueDirective,
+	"block-all-mixed-content":   noValueDirective,
+	"sandbox":                   tokenListDirective,
+	"report-uri":                tokenListDirective,
+	"report-to":                 tokenListDirective,
+	"require-trusted-types-for": requireTrustedTypesDirective,
+	"trusted-types":             trustedTypesDirective,
+}
+
+var cspKeywords = []string{
+	"'self'",
+	"'none'",
+	"'unsafe-inline'",
+	"'unsafe-eval'",
+	"'unsafe-hashes'",
+	"'strict-dynamic'",
+	"'report-sample'",
+	"'wasm-unsafe-eval'",
+	"'unsafe-allow-redirects'",
+}
+
+var (
+	cspNonceRx  = regexp.MustCompile(`\A'nonce-[[:alnum:]+/_=-]+'\z`)
+	cspHashRx   = regexp.MustCompile(`\A'sha(256|384|512)-[[:alnum:]+/_=-]+'\z`)
+	cspSchemeRx = regexp.MustCompile(`\A[[:alpha:]][[:alnum:]+.-]*:\z`)
+	cspHostRx   = regexp.MustCompile(`\A([[:alpha:]][[:alnum:]+.-]*://)?(\*|(\*\.)?[[:alnum:]-]+(\.[[:alnum:]-]+)*)(:([0-9]+|\*))?(/[^;,[:space:]]*)?\z`)
+
+	trustedTypesPolicyRx = regexp.MustCompile(`\A[[:alnum:]\-#=_/@.%]+\z`)
+)
+
+func ParseCSPPolicy(policy string) (CSPPolicy, error) {
+	res := CSPPolicy{}
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if _, ok := res.Get(name); ok == true {
+			return nil, fmt.Errorf("duplicated directive '%s'", name)
+		}
+		res = append(res, CSPDirective{Name: name, Sources: fields[1:]})
+	}
+	return res, nil
+}
+
+func (p CSPPolicy) Get(name string) ([]string, bool) {
+	for _, d := range p {
+		if d.Name == name {
+			return d.Sources, true
+		}
+	}
+	return nil, false
+}
+
+// Merge returns a new policy where each directive of overrides
+// replaces the one of p, or is appended if p does not define it.
+func (p CSPPolicy) Merge(overrides CSPPolicy) CSPPolicy {
+	res := make(CSPPolicy, len(p), len(p)+len(overrides))
+	copy(res, p)
+	for _, o := range overrides {
+		idx := slices.IndexFunc(res, func(d CSPDirective) bool { return d.Name == o.Name })
+		if idx < 0 {
+			res = append(res, o)
+		} else {
+			res[idx] = o
+		}
+	}
+	return res
+}
+
+// Without returns a new policy without the directive name.
+func (p CSPPolicy) Without(name string) CSPPolicy {
+	res := make(CSPPolicy, 0, len(p))
+	for _, d := range p {
+		if d.Name != name {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+func (p CSPPolicy) String() string {
+	directives := make([]string, len(p))
+	for i, d := range p {
+		directives[i] = strings.Join(append([]string{d.Name}, d.Sources...), " ")
+	}
+	return strings.Join(directives, "; ")
+}
+
+// Template returns the policy as a text/template where the nonce
+// placeholder is replaced by the request nonce.
+func (p CSPPolicy) Template() string {
+	return strings.ReplaceAll(p.String(), CSPNoncePlaceholder, "{{.Nonce}}")
+}
+
+func (p CSPPolicy) Validate() error {
+	var errs []error
+	for _, d := range p {
+		errs = append(errs, d.validate())
+	}
+
+	if _, ok := p.Get("default-src"); ok == false {
+		errs = append(errs, errors.New("missing 'default-src' directive"))
+	}
+
+	for _, name := range []string{"script-src", "style-src"} {
+		isScript := name == "script-src"
+		sources, ok := p.Get(name)
+		if ok == false {
+			name = "default-src"
+			sources, ok = p.Get(name)
+		}
+		if ok == false || slices.Contains(sources, "'none'") {
+			continue
+		}
+		if isScript == true && slices.Contains(sources, "'strict-dynamic'") {
+			// 'self' is ignored with 'strict-dynamic', only nonced or
+			// hashed scripts are allowed to load the bundle.
+			if slices.ContainsFunc(sources, isNonceOrHash) == false {
+				errs = append(errs, fmt.Errorf("'%s' uses 'strict-dynamic' without a nonce or hash: the application bundle could not be loaded", name))
+			}
+			continue
+		}
+		if slices.Contains(sources, "'self'") == false {
+			errs = append(errs, fmt.Errorf("'%s' is missing 'self': the application bundle could not be loaded", name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (d CSPDirective) validate() error {
+	kind, ok := cspDirectives[d.Name]
+	if ok == false {
+		return fmt.Errorf("unknown directive '%s'", d.Name)
+	}
+
+	switch kind {
+	case noValueDirective:
+		if len(d.Sources) > 0 {
+			return fmt.Errorf("directive '%s' does not accept any value", d.Name)
+		}
+		return nil
+	case tokenListDirective:
+		if len(d.Sources) == 0 {
+			return fmt.Errorf("directive '%s' requires a value", d.Name)
+		}
+		return nil
+	case requireTrustedTypesDirective:
+		if len(d.Sources) != 1 || d.Sources[0] != "'script'" {
+			return fmt.Errorf("directive '%s' only accepts 'script'", d.Name)
+		}
+		return nil
+	case trustedTypesDirective:
+		var errs []error
+		for _, name := range d.Sources {
+			if name == "'none'" || name == "'allow-duplicates'" || name == "*" {
+				continue
+			}
+			if trustedTypesPolicyRx.MatchString(name) == false {
+				errs = append(errs, fmt.Errorf("directive '%s': invalid policy name '%s'", d.Name, name))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	if len(d.Sources) == 0 {
+		return fmt.Errorf("directive '%s' requires at least one source, use 'none' to block everything", d.Name)
+	}
+
+	var errs []error
+	for _, source := range d.Sources {
+		if err := validateCSPSource(source); err != nil {
+			errs = append(errs, fmt.Errorf("directive '%s': %w", d.Name, err))
+		}
+	}
+
+	if slices.Contains(d.Sources, "'none'") && len(d.Sources) > 1 {
+		errs = append(errs, fmt.Errorf("directive '%s': 'none' must be the only source", d.Name))
+	}
+
+	if slices.ContainsFunc(d.Sources, isNonceOrHash) && slices.Contains(d.Sources, "'unsafe-inline'") {
+		errs = append(errs, fmt.Errorf("directive '%s': 'unsafe-inline' is ignored when a nonce or hash is present", d.Name))
+	}
+
+	return errors.Join(errs...)
+}
+
+func isNonceOrHash(source string) bool {
+	return cspNonceRx.MatchString(source) || cspHashRx.MatchString(source)
+}
+
+func validateCSPSource(source string) error {
+	if slices.Contains(cspKeywords, source) ||
+		isNonceOrHash(source) ||
+		cspSchemeRx.MatchString(source) ||
+		cspHostRx.MatchString(source) {
+
+		if slices.Contains(cspKeywords, "'"+source+"'") {
+			return fmt.Errorf("keyword '%s' must be single-quoted", source)
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(source, "'") {
+		return fmt.Errorf("unknown keyword %s", source)
+	}
+
+	return fmt.Errorf("invalid source expression '%s'", source)
+}
+
+// UnmarshalJSON accepts either a policy string, or an object mapping
+// each directive name to its source list. Directive order is
+// preserved.
+func (p *CSPPolicy) UnmarshalJSON(data []byte) error {
+	var policy string
+	if err := json.Unmarshal(data, &policy); err == nil {
+		res, err := ParseCSPPolicy(policy)
+		if err != nil {
+			return err
+		}
+		*p = res
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return errors.New("CSP policy should be a string or an object")
+	}
+
+	res := CSPPolicy{}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name := strings.ToLower(t.(string))
+		if _, ok := res.Get(name); ok == true {
+			return fmt.Errorf("duplicated directive '%s'", name)
+		}
+
+		var sources []string
+		if err := dec.Decode(&sources); err != nil {
+			return fmt.Errorf("directive '%s': %w", name, err)
+		}
+		res = append(res, CSPDirective{Name: name, Sources: sources})
+	}
+
+	*p = res
+	return nil
+}
+
+// WithSource returns a copy of p where source is added to the
+// directive name. If the directive is missing, it is created from
+// 'default-src'.
+func (p CSPPolicy) WithSource(name, source string) CSPPolicy {
+	sources, ok := p.Get(name)
+	if ok == false {
+		sources, _ = p.Get("default-src")
+	}
+	if slices.Contains(sources, source) {
+		return p
+	}
+	sources = append(slices.Clone(sources), source)
+	return p.Merge(CSPPolicy{{Name: name, Sources: sources}})
+}
+
+var AngularTrustedTypesPolicies = []string{"angular", "angular#bundler"}
+
+type CSPConfig struct {
+	Policy CSPPolicy            `json:"policy"`
+	Routes map[string]CSPPolicy `json:"routes"`
+
+	StrictDynamic       bool     `json:"strict-dynamic"`
+	TrustedTypes        []string `json:"trusted-types"`
+	RequireTrustedTypes bool     `json:"require-trusted-types"`
+
+	Headers map[string]string `json:"headers"`
+	MetaTag bool              `json:"meta-tag"`
+}
+
+// HeaderNames returns the sorted names of the additional nonced
+// headers.
+func (c CSPConfig) HeaderNames() []string {
+	res := make([]string, 0, len(c.Headers))
+	for name := range c.Headers {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+var headerNameRx = regexp.MustCompile("\\A[!#$%&'*+.^_`|~[:alnum:]-]+\\z")
+
+func parseNoncedHeader(header string) (string, string, error) {
+	name, value, ok := strings.Cut(header, ":")
+	name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	if ok == false || headerNameRx.MatchString(name) == false {
+		return "", "", fmt.Errorf("invalid header '%s': should be 'Name: value'", header)
+	}
+	return name, strings.TrimSpace(value), nil
+}
+
+func (c CSPConfig) PolicyFor(target string) CSPPolicy {
+	res := c.Policy.Merge(c.Routes[target])
+	if c.StrictDynamic == true {
+		res = res.WithSource("script-src", "'strict-dynamic'")
+	}
+	if _, ok := res.Get("trusted-types"); ok == false && len(c.TrustedTypes) > 0 {
+		res = append(res, CSPDirective{Name: "trusted-types", Sources: c.TrustedTypes})
+	}
+	if _, ok := res.Get("require-trusted-types-for"); ok == false && c.RequireTrustedTypes == true {
+		res = append(res, CSPDirective{Name: "require-trusted-types-for", Sources: []string{"'script'"}})
+	}
+	return res
+}
+
+// requiresTrustedTypes reports if any policy of c enforces Trusted
+// Types, from RequireTrustedTypes or from a written
+// 'require-trusted-types-for' directive.
+func (c CSPConfig) requiresTrustedTypes() bool {
+	if _, ok := c.PolicyFor("").Get("require-trusted-types-for"); ok == true {
+		return true
+	}
+	for target := range c.Routes {
+		if _, ok := c.PolicyFor(target).Get("require-trusted-types-for"); ok == true {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutTrustedTypes returns c where no policy enforces Trusted
+// Types. Allowed policy names are kept.
+func (c CSPConfig) withoutTrustedTypes() CSPConfig {
+	c.RequireTrustedTypes = false
+	c.Policy = c.Policy.Without("require-trusted-types-for")
+	routes := make(map[string]CSPPolicy, len(c.Routes))
+	for target, policy := range c.Routes {
+		routes[target] = policy.Without("require-trusted-types-for")
+	}
+	c.Routes = routes
+	return c
+}
+
+func (c CSPConfig) Validate() error {
+	if err := c.PolicyFor("").Validate(); err != nil {
+		return fmt.Errorf("invalid CSP policy: %w", err)
+	}
+
+	for target := range c.Routes {
+		if err := c.PolicyFor(target).Validate(); err != nil {
+			return fmt.Errorf("invalid CSP policy for '%s': %w", target, err)
+		}
+	}
+
+	return nil
+}
+
+func loadCSPConfig(config Config) (CSPConfig, error) {
+	policy, err := ParseCSPPolicy(config.CSP.Policy)
+	if err != nil {
+		return CSPConfig{}, fmt.Errorf("invalid --csp.policy: %w", err)
+	}
+
+	res := CSPConfig{}
+	if len(config.CSP.ConfigFile) > 0 {
+		if err := loadJSONFile(config.CSP.ConfigFile, &res); err != nil {
+			return CSPConfig{}, err
+		}
+	}
+
+	if len(res.Policy) == 0 {
+		res.Policy = policy
+	}
+
+	if config.CSP.StrictDynamic == true {
+		res.StrictDynamic = true
+	}
+
+	if config.CSP.MetaTag == true {
+		res.MetaTag = true
+	}
+
+	for _, header := range config.CSP.Headers {
+		name, value, err := parseNoncedHeader(header)
+		if err != nil {
+			return CSPConfig{}, err
+		}
+		if res.Headers == nil {
+			res.Headers = make(map[string]string)
+		}
+		res.Headers[name] = value
+	}
+
+	if config.CSP.TrustedTypes == true {
+		if len(res.TrustedTypes) == 0 {
+			res.TrustedTypes = config.CSP.TrustedTypesPolicies
+		}
+		res.RequireTrustedTypes = true
+	}
+
+	return res, res.Validate()
+}
+
+var mainBundleRx = regexp.MustCompile(`\Amain([.-][[:alnum:]]+)?\.js\z`)
+
+// bundleUsesTrustedTypes checks that the angular main bundles in
+// root, or in each of its locale directories for localized builds,
+// create Trusted Types policies, otherwise enforcing them would break
+// the application.
+func bundleUsesTrustedTypes(root string, locales *localeRouter) (bool, error) {
+	if locales == nil {
+		return mainBundleUsesTrustedTypes(root)
+	}
+	for _, locale := range locales.locales {
+		supported, err := mainBundleUsesTrustedTypes(filepath.Join(root, locale))
+		if supported == false {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func mainBundleUsesTrustedTypes(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for _, e := range entries {
+		if e.IsDir() == true || mainBundleRx.MatchString(e.Name()) == false {
+			continue
+		}
+		found = true
+		content, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return false, err
+		}
+		if bytes.Contains(content, []byte("trustedTypes")) {
+			return true, nil
+		}
+	}
+	if found == false {
+		return false, fmt.Errorf("no main bundle found in '%s'", dir)
+	}
+	return false, nil
+}
@@ -0,0 +1,208 @@
+package ath
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type CSPSuite struct{}
+
+var _ = Suite(&CSPSuite{})
+
+func (s *CSPSuite) TestParse(c *C) {
+	policy, err := ParseCSPPolicy(" default-src 'self' ;Script-Src 'self' 'nonce-CSP_NONCE';;")
+	c.Assert(err, IsNil)
+	c.Check(policy, DeepEquals, CSPPolicy{
+		{Name: "default-src", Sources: []string{"'self'"}},
+		{Name: "script-src", Sources: []string{"'self'", "'nonce-CSP_NONCE'"}},
+	})
+	c.Check(policy.String(), Equals, "default-src 'self'; script-src 'self' 'nonce-CSP_NONCE'")
+	c.Check(policy.Template(), Equals, "default-src 'self'; script-src 'self' 'nonce-{{.Nonce}}'")
+
+	_, err = ParseCSPPolicy("default-src 'self'; default-src 'none'")
+	c.Check(err, ErrorMatches, "duplicated directive 'default-src'")
+}
+
+func (s *CSPSuite) TestMerge(c *C) {
+	policy, err := ParseCSPPolicy("default-src 'self'; style-src 'self'")
+	c.Assert(err, IsNil)
+	overrides, err := ParseCSPPolicy("style-src 'self' 'nonce-CSP_NONCE'; img-src 'self' data:")
+	c.Assert(err, IsNil)
+
+	c.Check(policy.Merge(overrides).String(), Equals,
+		"default-src 'self'; style-src 'self' 'nonce-CSP_NONCE'; img-src 'self' data:")
+	c.Check(policy.String(), Equals, "default-src 'self'; style-src 'self'")
+}
+
+func (s *CSPSuite) TestValidate(c *C) {
+	testdata := []struct {
+		Policy, Error string
+	}{
+		{"default-src 'self'; style-src 'self' 'nonce-CSP_NONCE'; script-src 'self' 'nonce-CSP_NONCE'", ""},
+		{"default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self' https://*.example.com:443/img/ data:; upgrade-insecure-requests", ""},
+		{"default-src 'self'; script-src 'self' 'sha384-abcd+/=='; report-uri /csp-report", ""},
+		{"script-src 'self'", "missing 'default-src' directive"},
+		{"default-src 'self'; foo-src 'self'", "unknown directive 'foo-src'"},
+		{"default-src self", "(?s).*keyword 'self' must be single-quoted.*"},
+		{"default-src 'self' 'unsafe'", "directive 'default-src': unknown keyword 'unsafe'"},
+		{"default-src 'self' http://exa_mple.com", "directive 'default-src': invalid source expression 'http://exa_mple.com'"},
+		{"default-src 'self'; script-src 'unsafe-eval'", "'script-src' is missing 'self': .*"},
+		{"default-src https:", "(?s)'default-src' is missing 'self'.*"},
+		{"default-src 'self'; img-src 'none' 'self'", "directive 'img-src': 'none' must be the only source"},
+		{"default-src 'self'; img-src", "directive 'img-src' requires at least one source.*"},
+		{"default-src 'self'; upgrade-insecure-requests 1", "directive 'upgrade-insecure-requests' does not accept any value"},
+		{"default-src 'self'; script-src 'self' 'unsafe-inline' 'nonce-CSP_NONCE'", "directive 'script-src': 'unsafe-inline' is ignored when a nonce or hash is present"},
+	}
+
+	for _, d := range testdata {
+		comment := Commentf("policy: %s", d.Policy)
+		policy, err := ParseCSPPolicy(d.Policy)
+		c.Assert(err, IsNil, comment)
+		err = policy.Validate()
+		if len(d.Error) == 0 {
+			c.Check(err, IsNil, comment)
+		} else {
+			c.Check(err, ErrorMatches, d.Error, comment)
+		}
+	}
+}
+
+func (s *CSPSuite) TestUnmarshalJSON(c *C) {
+	config := CSPConfig{}
+	err := json.Unmarshal([]byte(`{
+  "policy": {
+    "default-src": ["'self'"],
+    "style-src": ["'self'", "'nonce-CSP_NONCE'"],
+    "script-src": ["'self'", "'nonce-CSP_NONCE'"]
+  },
+  "routes": {
+    "/admin.html": "img-src 'self' data:"
+  }
+}`), &config)
+	c.Assert(err, IsNil)
+	c.Check(config.Policy.String(), Equals, "default-src 'self'; style-src 'self' 'nonce-CSP_NONCE'; script-src 'self' 'nonce-CSP_NONCE'")
+	c.Check(config.PolicyFor("/index.html").String(), Equals, config.Policy.String())
+	c.Check(config.PolicyFor("/admin.html").String(), Equals, config.Policy.String()+"; img-src 'self' data:")
+	c.Check(config.Validate(), IsNil)
+
+	err = json.Unmarshal([]byte(`{"policy": {"default-src": ["'self'"], "default-src": ["'none'"]}}`), &config)
+	c.Check(err, ErrorMatches, "duplicated directive 'default-src'")
+
+	err = json.Unmarshal([]byte(`{"policy": ["default-src"]}`), &config)
+	c.Check(err, ErrorMatches, "CSP policy should be a string or an object")
+
+	err = json.Unmarshal([]byte(`{"policy": "default-src 'self'", "routes": {"/index.html": "script-src 'unsafe-inline'"}}`), &config)
+	c.Assert(err, IsNil)
+	c.Check(config.Validate(), ErrorMatches, "invalid CSP policy for '/index.html': 'script-src' is missing 'self'.*")
+}
+
+func (s *CSPSuite) TestLoadConfig(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "csp.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`{"routes":{"/index.html":{"img-src":["'self'","data:"]}}}`), 0644), IsNil)
+
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"--csp.config", path})
+	c.Assert(err, IsNil)
+	csp, err := loadCSPConfig(config)
+	c.Assert(err, IsNil)
+	c.Check(csp.PolicyFor("/index.html").String(), Equals,
+		"default-src 'self'; style-src 'self' 'nonce-CSP_NONCE'; script-src 'self' 'nonce-CSP_NONCE'; img-src 'self' data:")
+
+	config = Config{}
+	_, err = flags.ParseArgs(&config, []string{"--csp.policy", "script-src 'self'"})
+	c.Assert(err, IsNil)
+	_, err = loadCSPConfig(config)
+	c.Check(err, ErrorMatches, "invalid CSP policy: missing 'default-src' directive")
+
+	c.Assert(ioutil.WriteFile(path, []byte(`{"policies":{}}`), 0644), IsNil)
+	config = Config{}
+	_, err = flags.ParseArgs(&config, []string{"--csp.config", path})
+	c.Assert(err, IsNil)
+	_, err = loadCSPConfig(config)
+	c.Check(err, ErrorMatches, "parsing '.*/csp.json': json: unknown field \"policies\"")
+}
+
+func (s *CSPSuite) TestStrictDynamicAndTrustedTypes(c *C) {
+	policy, err := ParseCSPPolicy("default-src 'self' 'nonce-CSP_NONCE'; style-src 'self' 'nonce-CSP_NONCE'")
+	c.Assert(err, IsNil)
+	config := CSPConfig{
+		Policy:              policy,
+		Routes:              map[string]CSPPolicy{"/other.html": {{Name: "trusted-types", Sources: []string{"'none'"}}}},
+		StrictDynamic:       true,
+		TrustedTypes:        AngularTrustedTypesPolicies,
+		RequireTrustedTypes: true,
+	}
+	c.Check(config.Validate(), IsNil)
+	c.Check(config.PolicyFor("/index.html").String(), Equals,
+		"default-src 'self' 'nonce-CSP_NONCE'; style-src 'self' 'nonce-CSP_NONCE'; "+
+			"script-src 'self' 'nonce-CSP_NONCE' 'strict-dynamic'; "+
+			"trusted-types angular angular#bundler; require-trusted-types-for 'script'")
+	c.Check(config.PolicyFor("/other.html").String(), Equals,
+		"default-src 'self' 'nonce-CSP_NONCE'; style-src 'self' 'nonce-CSP_NONCE'; trusted-types 'none'; "+
+			"script-src 'self' 'nonce-CSP_NONCE' 'strict-dynamic'; require-trusted-types-for 'script'")
+
+	config.Policy, err = ParseCSPPolicy("default-src 'self'")
+	c.Assert(err, IsNil)
+	c.Check(config.Validate(), ErrorMatches,
+		"invalid CSP policy: 'script-src' uses 'strict-dynamic' without a nonce or hash.*")
+
+	testdata := []struct {
+		Policy, Error string
+	}{
+		{"default-src 'self'; require-trusted-types-for 'script'; trusted-types angular angular#unsafe-bypass 'allow-duplicates'", ""},
+		{"default-src 'self'; require-trusted-types-for 'style'", "directive 'require-trusted-types-for' only accepts 'script'"},
+		{"default-src 'self'; trusted-types angular$", "directive 'trusted-types': invalid policy name 'angular\\$'"},
+	}
+	for _, d := range testdata {
+		comment := Commentf("policy: %s", d.Policy)
+		policy, err := ParseCSPPolicy(d.Policy)
+		c.Assert(err, IsNil, comment)
+		err = policy.Validate()
+		if len(d.Error) == 0 {
+			c.Check(err, IsNil, comment)
+		} else {
+			c.Check(err, ErrorMatches, d.Error, comment)
+		}
+	}
+}
+
+func (s *CSPSuite) TestBundleUsesTrustedTypes(c *C) {
+	supported, err := bundleUsesTrustedTypes("utest-data/utest-app", nil)
+	c.Check(supported, Equals, false)
+	c.Check(err, IsNil)
+
+	dir := c.MkDir()
+	supported, err = bundleUsesTrustedTypes(dir, nil)
+	c.Check(supported, Equals, false)
+	c.Check(err, ErrorMatches, "no main bundle found in '.*'")
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "main-ABCDEF12.js"),
+		[]byte(`window.trustedTypes.createPolicy("angular",{})`), 0644), IsNil)
+	supported, err = bundleUsesTrustedTypes(dir, nil)
+	c.Check(supported, Equals, true)
+	c.Check(err, IsNil)
+
+	// every locale of localized builds should use them.
+	dir = writeLocalizedApp(c)
+	locales := &localeRouter{locales: []string{"en-US", "fr"}}
+	supported, err = bundleUsesTrustedTypes(dir, locales)
+	c.Check(supported, Equals, false)
+	c.Check(err, IsNil)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "en-US", "main.0123456789abcdef.js"),
+		[]byte(`window.trustedTypes.createPolicy("angular",{})`), 0644), IsNil)
+	supported, err = bundleUsesTrustedTypes(dir, locales)
+	c.Check(supported, Equals, false)
+	c.Check(err, IsNil)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "fr", "main.0123456789abcdef.js"),
+		[]byte(`window.trustedTypes.createPolicy("angular",{})`), 0644), IsNil)
+	supported, err = bundleUsesTrustedTypes(dir, locales)
+	c.Check(supported, Equals, true)
+	c.Check(err, IsNil)
+}
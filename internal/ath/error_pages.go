@@ -0,0 +1,164 @@
+package ath
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// errorStatuses are the statuses that can have an error page.
+var errorStatuses = []int{
+	http.StatusNotFound,
+	http.StatusMethodNotAllowed,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// buildErrorPages returns the routes of the '<status>.html' error
+// pages found in --error-pages.dir, or in the served directory.
+func (b *routeBuilder) buildErrorPages() (map[int]Route, error) {
+	dir := b.config.ErrorPages.Directory
+	if len(dir) > 0 {
+		if info, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("error pages: %w", err)
+		} else if info.IsDir() == false {
+			return nil, fmt.Errorf("error pages: '%s' is not a directory", dir)
+		}
+	} else {
+		dir = b.root
+	}
+
+	res := make(map[int]Route)
+	for _, status := range errorStatuses {
+		path := filepath.Join(dir, strconv.Itoa(status)+".html")
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) == true {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		route, err := b.buildErrorPage(path, fs.FileInfoToDirEntry(info))
+		if err != nil {
+			return nil, fmt.Errorf("error page '%s': %w", path, err)
+		}
+		res[status] = route
+		zap.L().Debug("error page", zap.Int("status", status), zap.String("path", path))
+	}
+	return res, nil
+}
+
+func (b *routeBuilder) buildErrorPage(path string, d fs.DirEntry) (Route, error) {
+	if b.config.ErrorPages.Nonced == true && b.config.CSP.Disable == false {
+		route, err := b.buildNoncedRoute("/"+filepath.Base(path), path)
+		if err == nil {
+			return route, nil
+		}
+		if err != ErrNonNonceable {
+			return nil, err
+		}
+		zap.L().Warn("error page has no ng_csp_nonced attribute, serving it without nonce",
+			zap.String("path", path))
+	}
+	route, err := b.buildStaticRoute(path, d)
+	if err != nil {
+		return nil, err
+	}
+	static := route.(StaticRoute)
+	static.cacheControl = "no-store"
+	return static, nil
+}
+
+type errorPages map[int]Route
+
+// WithErrorPages replaces the body of error responses with the page
+// of their status, if any.
+func WithErrorPages(pages map[int]Route) HandlerOption {
+	return func(h *Handler) {
+		if len(pages) > 0 {
+			h.errorPages = pages
+		}
+	}
+}
+
+// wrap returns a ResponseWriter serving the error page of the status
+// written to w, instead of the body written by the handler.
+func (p errorPages) wrap(w http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	if len(p) == 0 {
+		return w
+	}
+	return &errorPageWriter{ResponseWriter: w, req: req, pages: p}
+}
+
+func (w *errorPageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type errorPageWriter struct {
+	http.ResponseWriter
+	req   *http.Request
+	pages errorPages
+
+	wroteHeader, intercepted bool
+}
+
+func (w *errorPageWriter) WriteHeader(status int) {
+	if w.wroteHeader == true {
+		return
+	}
+	w.wroteHeader = true
+	page, ok := w.pages[status]
+	if ok == false {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.intercepted = true
+	// headers of the original body, e.g. set by http.Error.
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	page.ServeHTTP(&statusWriter{ResponseWriter: w.ResponseWriter, status: status}, errorPageRequest(w.req))
+}
+
+func (w *errorPageWriter) Write(data []byte) (int, error) {
+	if w.wroteHeader == false {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.intercepted == true {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// statusWriter replaces the 200 status of a page by status.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if status == http.StatusOK {
+		status = w.status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// errorPageRequest returns req without the headers that would make
+// the error page a partial or not modified response.
+func errorPageRequest(req *http.Request) *http.Request {
+	res := req.Clone(req.Context())
+	for _, header := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		res.Header.Del(header)
+	}
+	if res.Method != http.MethodHead {
+		res.Method = http.MethodGet
+	}
+	return res
+}
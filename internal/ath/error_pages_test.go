@@ -0,0 +1,118 @@
+package ath
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type ErrorPagesSuite struct{}
+
+var _ = Suite(&ErrorPagesSuite{})
+
+func (s *ErrorPagesSuite) buildHandler(c *C, args ...string) *Handler {
+	dir := writeBundle(c, map[string]string{
+		"index.html":               "<html><body><app-root ng_csp_nonced></app-root></body></html>",
+		"main.0123456789abcdef.js": "main",
+		"404.html":                 "<html><body>bundle not found</body></html>",
+	})
+	var config Config
+	_, err := flags.ParseArgs(&config, append([]string{dir}, args...))
+	c.Assert(err, IsNil)
+	_, h, err := buildHandler(config, nil)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func (s *ErrorPagesSuite) TestBundlePages(c *C) {
+	h := s.buildHandler(c)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/chunk.0123456789abcdef.js", nil)
+	req.Header.Set("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusNotFound)
+	c.Check(w.Body.String(), Equals, "<html><body>bundle not found</body></html>")
+	c.Check(w.Header().Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	c.Check(w.Header().Get("Cache-Control"), Equals, "no-store")
+	c.Check(w.Header().Get("X-Content-Type-Options"), Equals, "nosniff")
+
+	// statuses without page keep the plain text body.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	c.Check(w.Code, Equals, http.StatusMethodNotAllowed)
+	c.Check(w.Body.String(), Equals, "method not allowed\n")
+}
+
+func (s *ErrorPagesSuite) TestDirectoryPages(c *C) {
+	dir := writeBundle(c, map[string]string{
+		"405.html": "<html><body>method not allowed</body></html>",
+		"429.html": "<html><head></head><body><app-root ng_csp_nonced></app-root></body></html>",
+		"418.html": "<html><body>ignored</body></html>",
+	})
+	h := s.buildHandler(c, "--error-pages.dir", dir, "--error-pages.nonced",
+		"--rate-limit.immutable", "1/h")
+	c.Check(h.errorPages, HasLen, 2)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/", nil))
+	c.Check(w.Code, Equals, http.StatusMethodNotAllowed)
+	c.Check(w.Header().Get("Allow"), Equals, "GET, HEAD, OPTIONS")
+	c.Check(w.Body.String(), Equals, "<html><body>method not allowed</body></html>")
+
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/main.0123456789abcdef.js", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		h.ServeHTTP(w, req)
+	}
+	c.Check(w.Code, Equals, http.StatusTooManyRequests)
+	c.Check(w.Header().Get("Retry-After"), Not(Equals), "")
+	c.Check(w.Header().Get("Content-Security-Policy"), Matches, ".*'nonce-[^']+'.*")
+	c.Check(w.Body.String(), Matches, `<html><head></head><body><app-root ngCspNonce="[^"]+"></app-root></body></html>`)
+
+	// a 404 without page in the directory.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/missing.js", nil))
+	c.Check(w.Code, Equals, http.StatusNotFound)
+	c.Check(w.Body.String(), Equals, "not found\n")
+}
+
+func (s *ErrorPagesSuite) TestRouteErrors(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "500.html"), []byte("<p>oops</p>"), 0644), IsNil)
+	page, err := (&routeBuilder{root: dir, sized: NewCache(-1), permanent: NewCache(-1)}).buildErrorPages()
+	c.Assert(err, IsNil)
+
+	h := NewHandler(map[string]Route{
+		"/index.html": StaticRoute{
+			route:    route{"index.html", "", nil},
+			filepath: filepath.Join(dir, "missing.html"),
+			cache:    NewCache(-1),
+		},
+	}, WithErrorPages(page))
+
+	for _, method := range []string{"GET", "HEAD"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/", nil))
+		c.Check(w.Code, Equals, http.StatusInternalServerError)
+		c.Check(w.Header().Get("Content-Type"), Equals, "text/html; charset=utf-8")
+		if method == "GET" {
+			c.Check(w.Body.String(), Equals, "<p>oops</p>")
+		} else {
+			c.Check(w.Body.String(), Equals, "")
+		}
+	}
+}
+
+func (s *ErrorPagesSuite) TestInvalidDirectory(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{c.MkDir(), "--error-pages.dir", filepath.Join(c.MkDir(), "missing")})
+	c.Assert(err, IsNil)
+	_, _, err = buildHandler(config, nil)
+	c.Check(err, ErrorMatches, "error pages: stat .*missing: no such file or directory")
+}
@@ -0,0 +1,82 @@
+package ath
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// fallbackRules decides which unknown paths are missing files rather
+// than application routes falling back to index.html.
+type fallbackRules struct {
+	extensions bool
+	exclude    []string
+
+	missing metric.Int64Counter
+}
+
+// WithFallbackRules returns a 404 instead of index.html for unknown
+// paths with the extension of an asset, unless allowExtensions is
+// set, or matching one of the exclude globs.
+func WithFallbackRules(allowExtensions bool, exclude []string) HandlerOption {
+	return func(h *Handler) {
+		h.fallback = newFallbackRules(allowExtensions == false, exclude)
+	}
+}
+
+func newFallbackRules(extensions bool, exclude []string) *fallbackRules {
+	res := &fallbackRules{extensions: extensions, exclude: exclude}
+	meter := otel.Meter("github.com/atuleu/angular-to-http")
+	var err error
+	res.missing, err = meter.Int64Counter("ath.missing_files",
+		metric.WithDescription("requests for missing files, which do not fall back to index.html"))
+	if err != nil {
+		zap.L().Warn("could not create missing files metric", zap.Error(err))
+	}
+	return res
+}
+
+// assetExtensions are the extensions of files built or copied into
+// bundles. Unknown paths with other extensions, such as
+// /users/john.doe, are application routes.
+var assetExtensions = map[string]bool{
+	".js": true, ".mjs": true, ".css": true, ".map": true, ".json": true,
+	".html": true, ".txt": true, ".xml": true, ".webmanifest": true, ".wasm": true,
+	".ico": true, ".png": true, ".jpg": true, ".jpeg": true, ".gif": true,
+	".svg": true, ".webp": true, ".avif": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	".mp3": true, ".mp4": true, ".webm": true, ".pdf": true,
+}
+
+// isFile returns true if the application path p, stripped from its
+// locale, should be a file rather than an application route.
+func (r *fallbackRules) isFile(p string) bool {
+	if r == nil {
+		return false
+	}
+	if r.extensions == true && assetExtensions[strings.ToLower(path.Ext(p))] == true {
+		return true
+	}
+	for _, pattern := range r.exclude {
+		if matchGlob(pattern, p) == true {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *fallbackRules) record(ctx context.Context, site string) {
+	if r.missing == nil {
+		return
+	}
+	if len(site) > 0 {
+		r.missing.Add(ctx, 1, metric.WithAttributes(attribute.String("site", site)))
+	} else {
+		r.missing.Add(ctx, 1)
+	}
+}
@@ -0,0 +1,113 @@
+package ath
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	. "gopkg.in/check.v1"
+)
+
+type FallbackSuite struct {
+	logs    *observer.ObservedLogs
+	restore func()
+}
+
+var _ = Suite(&FallbackSuite{})
+
+func (s *FallbackSuite) SetUpTest(c *C) {
+	var core zapcore.Core
+	core, s.logs = observer.New(zapcore.InfoLevel)
+	s.restore = zap.ReplaceGlobals(zap.New(core))
+}
+
+func (s *FallbackSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func (s *FallbackSuite) TestIsFile(c *C) {
+	testdata := []struct {
+		Extensions bool
+		Exclude    []string
+		Path       string
+		Expected   bool
+	}{
+		{true, nil, "/chunk-abc123.js", true},
+		{true, nil, "/assets/logo.svg", true},
+		{true, nil, "/users/42", false},
+		{true, nil, "/", false},
+		{true, nil, "/.well-known/acme", false},
+		{true, nil, "/assets/LOGO.PNG", true},
+		{true, nil, "/users/john.doe", false},
+		{true, nil, "/v1.2/docs", false},
+		{false, nil, "/chunk-abc123.js", false},
+		{false, []string{"/assets/**"}, "/assets/i18n/fr", true},
+		{false, []string{"/assets/**"}, "/users/42", false},
+		{true, []string{"/api/**"}, "/api/users", true},
+	}
+	for _, d := range testdata {
+		rules := newFallbackRules(d.Extensions, d.Exclude)
+		c.Check(rules.isFile(d.Path), Equals, d.Expected, Commentf("%+v", d))
+	}
+	var rules *fallbackRules
+	c.Check(rules.isFile("/main.js"), Equals, false)
+}
+
+func (s *FallbackSuite) TestHandler(c *C) {
+	h := NewHandler(map[string]Route{
+		"/index.html": flaggedRoute(NONCED),
+	}, WithFallbackRules(false, []string{"/assets/**"}))
+
+	testdata := []struct {
+		Path   string
+		Status int
+	}{
+		{"/", http.StatusNoContent},
+		{"/dashboard/settings", http.StatusNoContent},
+		{"/users/john.doe", http.StatusNoContent},
+		{"/chunk-abc123.js", http.StatusNotFound},
+		{"/styles.css", http.StatusNotFound},
+		{"/assets/i18n/fr", http.StatusNotFound},
+	}
+	for _, d := range testdata {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", d.Path, nil))
+		c.Check(w.Code, Equals, d.Status, Commentf("%s", d.Path))
+	}
+
+	missing := s.logs.FilterMessage("missing file").All()
+	c.Assert(missing, HasLen, 3)
+	c.Check(missing[0].ContextMap()["URL"], Equals, "/chunk-abc123.js")
+	c.Check(s.logs.FilterMessage("redirecting to '/index.html'").Len(), Equals, 3)
+
+	h = NewHandler(map[string]Route{
+		"/index.html": flaggedRoute(NONCED),
+	}, WithFallbackRules(true, nil))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/chunk-abc123.js", nil))
+	c.Check(w.Code, Equals, http.StatusNoContent)
+}
+
+func (s *FallbackSuite) TestLocalized(c *C) {
+	h := NewHandler(map[string]Route{
+		"/fr/index.html": flaggedRoute(NONCED),
+	}, WithLocales(&localeRouter{locales: []string{"fr"}, defaultLocale: "fr"}),
+		WithFallbackRules(false, []string{"/assets/**"}))
+
+	testdata := []struct {
+		Path   string
+		Status int
+	}{
+		{"/fr/dashboard", http.StatusNoContent},
+		{"/fr/main.0123456789abcdef.js", http.StatusNotFound},
+		{"/fr/assets/i18n/fr", http.StatusNotFound},
+		{"/main.0123456789abcdef.js", http.StatusFound},
+	}
+	for _, d := range testdata {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", d.Path, nil))
+		c.Check(w.Code, Equals, d.Status, Commentf("%s", d.Path))
+	}
+}
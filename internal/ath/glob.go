@@ -0,0 +1,62 @@
+package ath
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// cleanPath returns the canonical form of the URL path p, without
+// '.', '..' or repeated slashes, keeping its trailing slash. Globs
+// must be matched against clean paths, or '/assets/../admin' would
+// match '/assets/**'.
+func cleanPath(p string) string {
+	if len(p) == 0 {
+		return "/"
+	}
+	res := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") == true && res != "/" {
+		res += "/"
+	}
+	return res
+}
+
+// matchGlob reports whether the URL path p matches pattern. Segments
+// are matched with path.Match, and a '**' segment matches any number
+// of segments.
+func matchGlob(pattern, p string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(p, "/"))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(segments); i >= 0; i-- {
+				if matchSegments(pattern[1:], segments[i:]) == true {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); ok == false {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+func validateGlob(pattern string) error {
+	if strings.HasPrefix(pattern, "/") == false {
+		return fmt.Errorf("invalid pattern '%s': should start with '/'", pattern)
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
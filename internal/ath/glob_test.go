@@ -0,0 +1,50 @@
+package ath
+
+import . "gopkg.in/check.v1"
+
+type GlobSuite struct{}
+
+var _ = Suite(&GlobSuite{})
+
+func (s *GlobSuite) TestMatch(c *C) {
+	testdata := []struct {
+		Pattern, Path string
+		Matches       bool
+	}{
+		{"/index.html", "/index.html", true},
+		{"/index.html", "/index.htm", false},
+		{"/*.js", "/main.abcdef.js", true},
+		{"/*.js", "/assets/main.js", false},
+		{"/assets/**", "/assets/", true},
+		{"/assets/**", "/assets/img/logo.svg", true},
+		{"/assets/**", "/other/logo.svg", false},
+		{"/**/*.map", "/main.js.map", true},
+		{"/**/*.map", "/a/b/c/main.js.map", true},
+		{"/**/*.map", "/a/b/c/main.js", false},
+		{"/**", "/anything/at/all", true},
+	}
+
+	for _, d := range testdata {
+		c.Check(matchGlob(d.Pattern, d.Path), Equals, d.Matches, Commentf("%+v", d))
+	}
+}
+
+func (s *GlobSuite) TestValidate(c *C) {
+	c.Check(validateGlob("/assets/**"), IsNil)
+	c.Check(validateGlob("assets/**"), ErrorMatches, "invalid pattern 'assets/\\*\\*': should start with '/'")
+	c.Check(validateGlob("/[a-"), ErrorMatches, "invalid pattern '/\\[a-': syntax error in pattern")
+}
+
+func (s *GlobSuite) TestCleanPath(c *C) {
+	for p, expected := range map[string]string{
+		"":                     "/",
+		"/":                    "/",
+		"/assets/logo.svg":     "/assets/logo.svg",
+		"/assets/../dashboard": "/dashboard",
+		"/assets/../../etc/":   "/etc/",
+		"//assets/./i18n//fr/": "/assets/i18n/fr/",
+		"assets/../../x":       "/x",
+	} {
+		c.Check(cleanPath(p), Equals, expected, Commentf("%s", p))
+	}
+}
@@ -2,22 +2,46 @@ package ath
 
 import (
 	"net/http"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 type Handler struct {
-	routes map[string]Route
+	site            string
+	routes          map[string]Route
+	securityHeaders SecurityHeadersConfig
+	clientAuth      *clientAuth
+	rateLimiters    map[string]*rateLimiter
+	locales         *localeRouter
+	fallback        *fallbackRules
+	errorPages      errorPages
+	rules           rules
+	mounts          mounts
+	basePath        string
+	stripBaseHref   bool
 }
 
-func NewHandler(routes map[string]Route) *Handler {
+type HandlerOption func(*Handler)
+
+func WithSecurityHeaders(config SecurityHeadersConfig) HandlerOption {
+	return func(h *Handler) {
+		h.securityHeaders = config
+	}
+}
+
+func NewHandler(routes map[string]Route, options ...HandlerOption) *Handler {
 	if routes == nil {
 		routes = make(map[string]Route)
 	}
 
-	return &Handler{
+	res := &Handler{
 		routes: routes,
 	}
+	for _, o := range options {
+		o(res)
+	}
+	return res
 }
 
 type loggingResponseWriter struct {
@@ -30,32 +54,144 @@ func (w *loggingResponseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap allows http.ResponseController to flush and hijack
+// connections, e.g. for WebSocket upgrades of mounts.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (h *Handler) log(req *http.Request) *zap.Logger {
-	return zap.L().With(
+	fields := []zap.Field{
 		zap.String("method", req.Method),
 		zap.String("URL", req.URL.String()),
 		zap.String("address", req.RemoteAddr),
 		zap.String("user-agent", req.UserAgent()),
-	)
+	}
+	if len(h.site) > 0 {
+		fields = append(fields, zap.String("site", h.site))
+	}
+	if subject := clientSubject(req); len(subject) > 0 {
+		fields = append(fields, zap.String("client", subject))
+	}
+	if proxy := proxyAddress(req); len(proxy) > 0 {
+		fields = append(fields,
+			zap.String("scheme", requestScheme(req)),
+			zap.String("proxy", proxy))
+	}
+	return zap.L().With(fields...)
 }
 
+// allowedMethods are the methods of all routes.
+const allowedMethods = "GET, HEAD, OPTIONS"
+
 func (h *Handler) ServeHTTP(w_ http.ResponseWriter, req *http.Request) {
-	w := &loggingResponseWriter{w_, 0}
+	logged := &loggingResponseWriter{w_, 0}
+	w := h.errorPages.wrap(logged, req)
 	log := h.log(req)
 	defer func() {
-		log.Info("request", zap.Int("status", w.status))
+		log.Info("request", zap.Int("status", logged.status))
 	}()
 
-	route, ok := h.routes[req.URL.Path]
+	var mount *mount
+	mountPath := ""
+	if len(h.mounts) > 0 {
+		var err error
+		if mountPath, err = cleanEscapedPath(req.URL.EscapedPath()); err != nil {
+			http.Error(w, "invalid path", http.StatusBadRequest)
+			return
+		}
+		mount = h.mounts.match(mountPath)
+	}
+	// mounted responses only get the security headers their upstream
+	// does not set, see mount.serve.
+	if mount == nil {
+		h.securityHeaders.Apply(w.Header(), req.URL.Path)
+	}
+
+	if len(proxyAddress(req)) > 0 {
+		traceForwarded(req)
+	}
+
+	// redirects apply to all methods and do not require a client
+	// certificate, which is required according to the requested path,
+	// even if it is rewritten.
+	requested := req.URL.Path
+	if mount == nil {
+		var redirected bool
+		if req, redirected = h.applyRules(w, req); redirected == true {
+			return
+		}
+	}
+
+	if subject := clientSubject(req); len(subject) > 0 {
+		traceClientSubject(req, subject)
+	} else if h.clientAuth.required(requested) == true {
+		http.Error(w, "client certificate required", http.StatusForbidden)
+		return
+	}
+
+	if mount != nil {
+		// upstream errors are not replaced by error pages.
+		mount.serve(logged, w, req, mountPath, h.securityHeaders)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		w.Header().Set("Allow", allowedMethods)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := h.appPath(req.URL.Path)
+	if ok == false {
+		if req.URL.Path == h.basePath {
+			http.Redirect(w, req, h.basePath+"/"+query(req), http.StatusMovedPermanently)
+			return
+		}
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if h.stripBaseHref == true {
+		req = withPath(req, p)
+	}
+
+	route, ok := h.routes[h.target(p)]
+	if ok == true && isExpired(route, time.Now()) == true {
+		ok = false
+	}
 	if ok == false {
-		log.Info("redirecting to '/index.html'")
-		route, ok = h.routes["/index.html"]
+		if target := h.locales.redirect(req, p); len(target) > 0 {
+			w.Header().Add("Vary", "Accept-Language, Cookie")
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, req, h.basePath+target+query(req), http.StatusFound)
+			return
+		}
+		if h.fallback.isFile(h.locales.unlocalized(p)) == true {
+			log.Info("missing file", zap.Int("status", http.StatusNotFound))
+			h.fallback.record(req.Context(), h.site)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		index := h.target(h.locales.index(p))
+		log.Info("redirecting to '" + index + "'")
+		route, ok = h.routes[index]
 	}
 
-	if ok == false || req.Method != "GET" {
+	if ok == false {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 
+	if h.rateLimited(w, req, route) == true {
+		log.Info("rate limited", zap.String("class", routeClass(route)))
+		return
+	}
+
 	route.ServeHTTP(w, req)
 }
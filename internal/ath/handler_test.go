@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
+	"text/template"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -81,31 +82,107 @@ func (s *HandlerSuite) TestPostMethod(c *C) {
 	h.ServeHTTP(w, req)
 
 	c.Check(string(w.buffer.Bytes()), ResponseMatches, []string{
-		"HTTP/1.1 404 Ok",
+		"HTTP/1.1 405 Ok",
+		"Allow: GET, HEAD, OPTIONS",
 		"Content-Type: text/plain; charset=utf-8",
 		"X-Content-Type-Options: nosniff",
 		"",
-		"not found",
+		"method not allowed",
 	})
 
 	logs := s.logs.TakeAll()
-	c.Assert(logs, HasLen, 2)
-	for _, log := range logs {
-		c.Check(log.Level, Equals, zapcore.InfoLevel)
-		if c.Check(len(log.Context) >= 4, Equals, true) == false {
-			continue
-		}
-		c.Check(log.Context[0], Equals, zap.String("method", "POST"))
-		c.Check(log.Context[1], Equals, zap.String("URL", "/index.html"))
-		c.Check(log.Context[2].Key, Equals, "address")
-		c.Check(log.Context[3].Key, Equals, "user-agent")
+	c.Assert(logs, HasLen, 1)
+	c.Check(logs[0].Message, Matches, "request")
+	c.Assert(logs[0].Context, HasLen, 5)
+	c.Check(logs[0].Context[0], Equals, zap.String("method", "POST"))
+	c.Check(logs[0].Context[1], Equals, zap.String("URL", "/index.html"))
+	c.Check(logs[0].Context[4], Equals, zap.Int("status", 405))
+}
+
+func (s *HandlerSuite) TestOptionsMethod(c *C) {
+	h := NewHandler(nil)
+
+	w := NewMockResponseWritter()
+	req, err := http.NewRequest("OPTIONS", "/index.html", bytes.NewBuffer(nil))
+
+	c.Assert(err, IsNil)
+	h.ServeHTTP(w, req)
+
+	c.Check(string(w.buffer.Bytes()), ResponseMatches, []string{
+		"HTTP/1.1 204 Ok",
+		"Allow: GET, HEAD, OPTIONS",
+		"",
+		"",
+	})
+}
+
+func (s *HandlerSuite) TestHeadMethod(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "main.js"),
+		[]byte(`console.log("main")`), 0644), IsNil)
+	templ, err := template.New("content").Parse(`<html nonce="{{.Nonce}}"></html>`)
+	c.Assert(err, IsNil)
+	_, err = templ.New("CSP").Parse(`script-src 'nonce-{{.Nonce}}'`)
+	c.Assert(err, IsNil)
+	nonces := &countingNonces{}
+	routes := map[string]Route{
+		"/index.html": NoncedRoute{
+			route:    route{"index.html", "text/html; charset=utf-8", nil},
+			template: templ,
+			nonces:   nonces,
+		},
+		"/main.js": StaticRoute{
+			route:        route{"main.js", "", nil},
+			filepath:     filepath.Join(dir, "main.js"),
+			cacheControl: "no-cache",
+			cache:        NewCache(-1),
+		},
 	}
+	h := NewHandler(routes)
 
-	c.Check(logs[0].Message, Matches, "redirecting to '/index.html'")
-	c.Check(logs[1].Message, Matches, "request")
-	c.Assert(logs[1].Context, HasLen, 5)
-	c.Check(logs[1].Context[4], Equals, zap.Int("status", 404))
+	w := NewMockResponseWritter()
+	req, err := http.NewRequest("HEAD", "/main.js", bytes.NewBuffer(nil))
+	c.Assert(err, IsNil)
+	h.ServeHTTP(w, req)
+	c.Check(string(w.buffer.Bytes()), ResponseMatches, []string{
+		"HTTP/1.1 200 Ok",
+		"Accept-Ranges: bytes",
+		"Cache-Control: no-cache",
+		"Content-Length: 19",
+		"Content-Type: text/javascript; charset=utf-8",
+		"",
+		"",
+	})
+
+	for _, target := range []string{"/index.html", "/dashboard"} {
+		w = NewMockResponseWritter()
+		req, err = http.NewRequest("HEAD", target, bytes.NewBuffer(nil))
+		c.Assert(err, IsNil)
+		h.ServeHTTP(w, req)
+		c.Check(string(w.buffer.Bytes()), ResponseMatches, []string{
+			"HTTP/1.1 200 Ok",
+			"Cache-Control: no-store",
+			"Content-Type: text/html; charset=utf-8",
+			"",
+			"",
+		})
+	}
+	c.Check(nonces.count, Equals, 0)
 
+	w = NewMockResponseWritter()
+	req, err = http.NewRequest("GET", "/index.html", bytes.NewBuffer(nil))
+	c.Assert(err, IsNil)
+	h.ServeHTTP(w, req)
+	c.Check(nonces.count, Equals, 1)
+}
+
+type countingNonces struct {
+	count int
+}
+
+func (n *countingNonces) Nonce() (string, error) {
+	n.count += 1
+	return "abcdef", nil
 }
 
 func (s *HandlerSuite) TestStaticRoute(c *C) {
@@ -146,3 +223,41 @@ func (s *HandlerSuite) TestStaticRoute(c *C) {
 	c.Check(logs[0].Context[4], Equals, zap.Int("status", 200))
 
 }
+
+func (s *HandlerSuite) TestSecurityHeaders(c *C) {
+	h := NewHandler(nil, WithSecurityHeaders(SecurityHeadersConfig{
+		Headers: SecurityHeadersPresets["default"],
+	}))
+
+	w := NewMockResponseWritter()
+	req, err := http.NewRequest("GET", "/", bytes.NewBuffer(nil))
+
+	c.Assert(err, IsNil)
+	h.ServeHTTP(w, req)
+
+	c.Check(string(w.buffer.Bytes()), ResponseMatches, []string{
+		"HTTP/1.1 404 Ok",
+		"Content-Type: text/plain; charset=utf-8",
+		"X-Content-Type-Options: nosniff",
+		"",
+		"not found",
+	})
+}
+
+func (s *HandlerSuite) TestLogsForwardedClient(c *C) {
+	h := withForwarded(NewHandler(nil), testResolver(c, headerXForwardedFor, "10.0.0.1"))
+
+	req, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, IsNil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	h.ServeHTTP(NewMockResponseWritter(), req)
+
+	logs := s.logs.TakeAll()
+	c.Assert(logs, HasLen, 2)
+	fields := logs[1].ContextMap()
+	c.Check(fields["address"], Equals, "5.6.7.8")
+	c.Check(fields["scheme"], Equals, "https")
+	c.Check(fields["proxy"], Equals, "10.0.0.1:1234")
+}
@@ -0,0 +1,215 @@
+package ath
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+var localeRx = regexp.MustCompile(`\A[a-z]{2,3}(-[A-Za-z0-9]{2,8})*\z`)
+
+// detectLocales returns the subdirectories of root that look like
+// the output of 'ng build --localize', i.e. named after a locale and
+// holding an index.html.
+func detectLocales(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, entry := range entries {
+		if entry.IsDir() == false || localeRx.MatchString(entry.Name()) == false {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(root, entry.Name(), "index.html")); err == nil {
+			res = append(res, entry.Name())
+		}
+	}
+	return res, nil
+}
+
+type localeRouter struct {
+	locales       []string
+	defaultLocale string
+	cookie        string
+}
+
+// loadLocales returns nil if the served directory is not a localized
+// bundle. Locales are detected only if there is no root index.html.
+func loadLocales(config Config) (*localeRouter, error) {
+	locales := config.I18n.Locales
+	if len(locales) == 0 {
+		if _, err := os.Stat(filepath.Join(config.Args.Directory, "index.html")); err == nil {
+			return nil, nil
+		}
+		var err error
+		locales, err = detectLocales(config.Args.Directory)
+		if err != nil {
+			return nil, err
+		}
+		if len(locales) == 0 {
+			return nil, nil
+		}
+	}
+
+	for _, locale := range locales {
+		if localeRx.MatchString(locale) == false {
+			return nil, fmt.Errorf("invalid locale '%s'", locale)
+		}
+		if _, err := os.Stat(filepath.Join(config.Args.Directory, locale, "index.html")); err != nil {
+			return nil, fmt.Errorf("locale '%s': %w", locale, err)
+		}
+	}
+
+	res := &localeRouter{
+		locales:       locales,
+		defaultLocale: config.I18n.Default,
+		cookie:        config.I18n.Cookie,
+	}
+	if len(res.defaultLocale) == 0 {
+		res.defaultLocale = locales[0]
+	}
+	if slices.Contains(locales, res.defaultLocale) == false {
+		return nil, fmt.Errorf("default locale '%s' is not one of %s", res.defaultLocale, strings.Join(locales, ", "))
+	}
+	return res, nil
+}
+
+// locale returns the locale prefixing the URL path p, if any.
+func (l *localeRouter) locale(p string) (string, bool) {
+	first, _, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	if slices.Contains(l.locales, first) == true {
+		return first, true
+	}
+	return "", false
+}
+
+// unlocalized strips the locale prefix of target, if any.
+func (l *localeRouter) unlocalized(target string) string {
+	if l == nil {
+		return target
+	}
+	if locale, ok := l.locale(target); ok == true {
+		return strings.TrimPrefix(target, "/"+locale)
+	}
+	return target
+}
+
+// index returns the index file to fall back to for p.
+func (l *localeRouter) index(p string) string {
+	if l != nil {
+		if locale, ok := l.locale(p); ok == true {
+			return "/" + locale + "/index.html"
+		}
+	}
+	return "/index.html"
+}
+
+// redirect returns where to redirect req for the application path p
+// when it is not under a locale, or an empty string.
+func (l *localeRouter) redirect(req *http.Request, p string) string {
+	if l == nil {
+		return ""
+	}
+	locale, ok := l.locale(p)
+	if ok == true {
+		if p == "/"+locale {
+			return p + "/"
+		}
+		return ""
+	}
+	return "/" + l.negotiate(req) + p
+}
+
+func query(req *http.Request) string {
+	if len(req.URL.RawQuery) == 0 {
+		return ""
+	}
+	return "?" + req.URL.RawQuery
+}
+
+// negotiate returns the best locale for req, from its locale cookie,
+// its Accept-Language header or the default locale.
+func (l *localeRouter) negotiate(req *http.Request) string {
+	if len(l.cookie) > 0 {
+		if cookie, err := req.Cookie(l.cookie); err == nil {
+			if match := l.match(cookie.Value); len(match) > 0 {
+				return match
+			}
+		}
+	}
+	for _, language := range parseAcceptLanguage(req.Header.Get("Accept-Language")) {
+		if match := l.match(language); len(match) > 0 {
+			return match
+		}
+	}
+	return l.defaultLocale
+}
+
+// match returns the locale matching language exactly, or sharing its
+// primary language subtag.
+func (l *localeRouter) match(language string) string {
+	language = strings.ToLower(strings.ReplaceAll(language, "_", "-"))
+	for _, locale := range l.locales {
+		if strings.ToLower(locale) == language {
+			return locale
+		}
+	}
+	primary, _, _ := strings.Cut(language, "-")
+	for _, locale := range l.locales {
+		localePrimary, _, _ := strings.Cut(strings.ToLower(locale), "-")
+		if localePrimary == primary {
+			return locale
+		}
+	}
+	return ""
+}
+
+// parseAcceptLanguage returns the languages of an Accept-Language
+// header, by decreasing preference.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		language string
+		q        float64
+	}
+	var languages []weighted
+	for _, part := range strings.Split(header, ",") {
+		language, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if len(language) == 0 || language == "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok == true {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			languages = append(languages, weighted{language, q})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].q > languages[j].q
+	})
+	res := make([]string, len(languages))
+	for i, l := range languages {
+		res[i] = l.language
+	}
+	return res
+}
+
+// WithLocales falls back to the index of the locale prefixing each
+// request, and redirects other requests to the best locale.
+func WithLocales(locales *localeRouter) HandlerOption {
+	return func(h *Handler) {
+		h.locales = locales
+	}
+}
@@ -0,0 +1,161 @@
+package ath
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type I18nSuite struct{}
+
+var _ = Suite(&I18nSuite{})
+
+func writeLocalizedApp(c *C) string {
+	dir := c.MkDir()
+	for _, locale := range []string{"en-US", "fr"} {
+		c.Assert(os.MkdirAll(filepath.Join(dir, locale), 0755), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(dir, locale, "index.html"),
+			[]byte(`<html><head><base href="/`+locale+`/"></head><body><app-root ng_csp_nonced></app-root></body></html>`), 0644), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(dir, locale, "main.0123456789abcdef.js"), []byte(locale), 0644), IsNil)
+	}
+	c.Assert(os.MkdirAll(filepath.Join(dir, "assets"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "assets", "index.html"), []byte("not a locale"), 0644), IsNil)
+	return dir
+}
+
+func (s *I18nSuite) TestDetectLocales(c *C) {
+	dir := writeLocalizedApp(c)
+	locales, err := detectLocales(dir)
+	c.Assert(err, IsNil)
+	c.Check(locales, DeepEquals, []string{"en-US", "fr"})
+}
+
+func (s *I18nSuite) TestLoadLocales(c *C) {
+	dir := writeLocalizedApp(c)
+
+	testdata := []struct {
+		Args    []string
+		Locales []string
+		Default string
+		Error   string
+	}{
+		{Args: []string{dir}, Locales: []string{"en-US", "fr"}, Default: "en-US"},
+		{Args: []string{dir, "--i18n.default", "fr"}, Locales: []string{"en-US", "fr"}, Default: "fr"},
+		{Args: []string{dir, "--i18n.locale", "fr"}, Locales: []string{"fr"}, Default: "fr"},
+		{Args: []string{dir, "--i18n.default", "de"}, Error: "default locale 'de' is not one of en-US, fr"},
+		{Args: []string{dir, "--i18n.locale", "de"}, Error: "locale 'de': .*no such file or directory"},
+		{Args: []string{dir, "--i18n.locale", "../etc"}, Error: "invalid locale '../etc'"},
+	}
+
+	for _, d := range testdata {
+		var config Config
+		_, err := flags.ParseArgs(&config, d.Args)
+		c.Assert(err, IsNil)
+		locales, err := loadLocales(config)
+		if len(d.Error) > 0 {
+			c.Check(err, ErrorMatches, d.Error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(locales, NotNil)
+		c.Check(locales.locales, DeepEquals, d.Locales)
+		c.Check(locales.defaultLocale, Equals, d.Default)
+	}
+
+	// not a localized application.
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"utest-data/utest-app"})
+	c.Assert(err, IsNil)
+	locales, err := loadLocales(config)
+	c.Check(err, IsNil)
+	c.Check(locales, IsNil)
+}
+
+func (s *I18nSuite) TestParseAcceptLanguage(c *C) {
+	c.Check(parseAcceptLanguage(""), HasLen, 0)
+	c.Check(parseAcceptLanguage("fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5"), DeepEquals,
+		[]string{"fr-CH", "fr", "en", "de"})
+	c.Check(parseAcceptLanguage("en;q=0.1, de, fr;q=0"), DeepEquals, []string{"de", "en"})
+}
+
+func (s *I18nSuite) TestNegotiate(c *C) {
+	locales := &localeRouter{
+		locales:       []string{"en-US", "fr", "pt-BR"},
+		defaultLocale: "en-US",
+		cookie:        "lang",
+	}
+
+	testdata := []struct {
+		AcceptLanguage, Cookie, Expected string
+	}{
+		{"", "", "en-US"},
+		{"fr-CH, fr;q=0.9", "", "fr"},
+		{"de, pt-br;q=0.5", "", "pt-BR"},
+		{"pt-PT", "", "pt-BR"},
+		{"en-GB", "", "en-US"},
+		{"de", "", "en-US"},
+		{"fr", "en-US", "en-US"},
+		{"fr", "unknown", "fr"},
+	}
+
+	for _, d := range testdata {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", d.AcceptLanguage)
+		if len(d.Cookie) > 0 {
+			req.AddCookie(&http.Cookie{Name: "lang", Value: d.Cookie})
+		}
+		c.Check(locales.negotiate(req), Equals, d.Expected, Commentf("%+v", d))
+	}
+}
+
+func (s *I18nSuite) TestRouting(c *C) {
+	dir := writeLocalizedApp(c)
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{dir})
+	c.Assert(err, IsNil)
+
+	routes, err := BuildRoutes(config)
+	c.Assert(err, IsNil)
+	c.Check(routes["/en-US/index.html"].Flags()&NONCED, Equals, NONCED)
+	c.Check(routes["/fr/index.html"].Flags()&NONCED, Equals, NONCED)
+	c.Check(routes["/assets/index.html"].Flags()&NONCED, Equals, RouteFlag(0))
+
+	locales, err := loadLocales(config)
+	c.Assert(err, IsNil)
+	h := NewHandler(routes, WithLocales(locales))
+
+	testdata := []struct {
+		Target, AcceptLanguage string
+		Status                 int
+		Location, Body         string
+	}{
+		{Target: "/", AcceptLanguage: "fr", Status: http.StatusFound, Location: "/fr/"},
+		{Target: "/", Status: http.StatusFound, Location: "/en-US/"},
+		{Target: "/dashboard?tab=1", AcceptLanguage: "fr", Status: http.StatusFound, Location: "/fr/dashboard?tab=1"},
+		{Target: "/fr", Status: http.StatusFound, Location: "/fr/"},
+		{Target: "/fr/", Status: http.StatusOK, Body: `<base href="/fr/">`},
+		{Target: "/fr/dashboard", Status: http.StatusOK, Body: `<base href="/fr/">`},
+		{Target: "/en-US/dashboard", AcceptLanguage: "fr", Status: http.StatusOK, Body: `<base href="/en-US/">`},
+		{Target: "/fr/main.0123456789abcdef.js", Status: http.StatusOK, Body: "fr"},
+	}
+
+	for _, d := range testdata {
+		comment := Commentf("%+v", d)
+		req := httptest.NewRequest("GET", d.Target, nil)
+		req.Header.Set("Accept-Language", d.AcceptLanguage)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		c.Check(w.Code, Equals, d.Status, comment)
+		if len(d.Location) > 0 {
+			c.Check(w.Header().Get("Location"), Equals, d.Location, comment)
+			c.Check(w.Header().Get("Vary"), Equals, "Accept-Language, Cookie", comment)
+		}
+		if len(d.Body) > 0 {
+			c.Check(w.Body.String(), Matches, "(?s).*"+d.Body+".*", comment)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package ath
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type integrityRewriter struct {
+	root string
+	// basePath prefixes absolute references to files of root, see
+	// --base-href.
+	basePath    string
+	crossOrigin string
+	hashes      map[string]string
+}
+
+func newIntegrityRewriter(root, basePath, crossOrigin string) *integrityRewriter {
+	return &integrityRewriter{
+		root:        root,
+		basePath:    basePath,
+		crossOrigin: crossOrigin,
+		hashes:      make(map[string]string),
+	}
+}
+
+var (
+	integrityTagRx  = regexp.MustCompile(`(?i)<(script|link)\b[^>]*>`)
+	htmlAttributeRx = regexp.MustCompile(`(?i)\s([a-z-]+)(\s*=\s*("([^"]*)"|'([^']*)'|([^\s"'>]+)))?`)
+)
+
+func parseHTMLAttributes(tag string) map[string]string {
+	res := make(map[string]string)
+	for _, m := range htmlAttributeRx.FindAllStringSubmatch(tag, -1) {
+		res[strings.ToLower(m[1])] = m[4] + m[5] + m[6]
+	}
+	return res
+}
+
+// Rewrite adds integrity and crossorigin attributes to all local
+// scripts and stylesheets referenced by the HTML file target.
+func (r *integrityRewriter) Rewrite(target string, content string) (string, error) {
+	var err error
+	res := integrityTagRx.ReplaceAllStringFunc(content, func(tag string) string {
+		if err != nil {
+			return tag
+		}
+		attributes := parseHTMLAttributes(tag)
+		if _, ok := attributes["integrity"]; ok == true {
+			return tag
+		}
+
+		var ref string
+		if strings.HasPrefix(strings.ToLower(tag), "<script") {
+			ref = attributes["src"]
+		} else if strings.ToLower(attributes["rel"]) == "stylesheet" {
+			ref = attributes["href"]
+		}
+		if len(ref) == 0 {
+			return tag
+		}
+
+		refTarget, local := resolveReference(r.basePath, target, ref)
+		if local == false {
+			return tag
+		}
+
+		var hash string
+		hash, err = r.hash(refTarget)
+		if err != nil {
+			err = fmt.Errorf("'%s' references '%s': %w", target, ref, err)
+			return tag
+		}
+
+		added := fmt.Sprintf(` integrity="%s"`, hash)
+		if _, ok := attributes["crossorigin"]; ok == false {
+			added += fmt.Sprintf(` crossorigin="%s"`, r.crossOrigin)
+		}
+
+		end := len(tag) - 1
+		if strings.HasSuffix(tag, "/>") {
+			end -= 1
+		}
+		return strings.TrimRight(tag[:end], " ") + added + tag[end:]
+	})
+
+	return res, err
+}
+
+// resolveReference returns the file of the bundle referenced by ref in
+// the HTML file target, or false if it is not a local file. Absolute
+// references are under basePath, relative ones are relative to the
+// <base href>, i.e. to target in the bundle.
+func resolveReference(basePath, target, ref string) (string, bool) {
+	u, err := url.Parse(ref)
+	if err != nil || u.IsAbs() || len(u.Host) > 0 {
+		return "", false
+	}
+	if strings.HasPrefix(u.Path, "/") == false {
+		return path.Join(path.Dir(target), u.Path), true
+	}
+	p := path.Clean(u.Path)
+	if len(basePath) == 0 {
+		return p, true
+	}
+	if strings.HasPrefix(p, basePath+"/") == false {
+		return "", false
+	}
+	return strings.TrimPrefix(p, basePath), true
+}
+
+func (r *integrityRewriter) hash(target string) (string, error) {
+	if hash, ok := r.hashes[target]; ok == true {
+		return hash, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(r.root, filepath.FromSlash(target)))
+	if err != nil {
+		return "", err
+	}
+	sum := sha512.Sum384(content)
+	hash := "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+	r.hashes[target] = hash
+	return hash, nil
+}
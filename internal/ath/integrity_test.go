@@ -0,0 +1,97 @@
+package ath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type IntegritySuite struct {
+	dir string
+}
+
+var _ = Suite(&IntegritySuite{})
+
+// sha384 of an empty file
+const emptySHA384 = "sha384-OLBgp1GsljhM2TJ\\+sbHjaiH9txEUvgdDTAzHv2P24donTt6/529l\\+9Ua0vFImLlb"
+
+func (s *IntegritySuite) SetUpSuite(c *C) {
+	s.dir = c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(s.dir, "assets"), 0755), IsNil)
+	for _, name := range []string{"main.js", "styles.css", "assets/lazy.js"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(s.dir, name), nil, 0644), IsNil)
+	}
+}
+
+func (s *IntegritySuite) TestRewrite(c *C) {
+	testdata := []struct {
+		Content, Expected string
+	}{
+		{
+			`<script src="main.js" type="module"></script>`,
+			`<script src="main.js" type="module" integrity="` + emptySHA384 + `" crossorigin="anonymous"></script>`,
+		},
+		{
+			`<link rel="stylesheet" href="/styles.css"/>`,
+			`<link rel="stylesheet" href="/styles.css" integrity="` + emptySHA384 + `" crossorigin="anonymous"/>`,
+		},
+		{
+			`<LINK REL=stylesheet HREF='assets/../styles.css' crossorigin>`,
+			`<LINK REL=stylesheet HREF='assets/../styles.css' crossorigin integrity="` + emptySHA384 + `">`,
+		},
+		{
+			`<script src=assets/lazy.js></script>`,
+			`<script src=assets/lazy.js integrity="` + emptySHA384 + `" crossorigin="anonymous"></script>`,
+		},
+		{
+			`<link rel="icon" href="favicon.ico"><script>inline()</script>`,
+			`<link rel="icon" href="favicon.ico"><script>inline\(\)</script>`,
+		},
+		{
+			`<script src="https://cdn.example.com/lib.js"></script><script src="//cdn.example.com/lib.js"></script>`,
+			`<script src="https://cdn.example.com/lib.js"></script><script src="//cdn.example.com/lib.js"></script>`,
+		},
+		{
+			`<script src="main.js" integrity="sha256-abc"></script>`,
+			`<script src="main.js" integrity="sha256-abc"></script>`,
+		},
+	}
+
+	rewriter := newIntegrityRewriter(s.dir, "", "anonymous")
+	for _, d := range testdata {
+		res, err := rewriter.Rewrite("/index.html", d.Content)
+		c.Check(err, IsNil, Commentf("%s", d.Content))
+		c.Check(res, Matches, d.Expected, Commentf("%s", d.Content))
+	}
+
+	_, err := rewriter.Rewrite("/index.html", `<script src="main.abcdef.js"></script>`)
+	c.Check(err, ErrorMatches, "'/index.html' references 'main.abcdef.js': open .*: no such file or directory")
+}
+
+func (s *IntegritySuite) TestBaseHref(c *C) {
+	rewriter := newIntegrityRewriter(s.dir, "/app", "anonymous")
+	testdata := []struct {
+		Content, Expected string
+	}{
+		{
+			`<script src="/app/main.js"></script>`,
+			`<script src="/app/main.js" integrity="` + emptySHA384 + `" crossorigin="anonymous"></script>`,
+		},
+		{
+			`<script src="assets/lazy.js"></script>`,
+			`<script src="assets/lazy.js" integrity="` + emptySHA384 + `" crossorigin="anonymous"></script>`,
+		},
+		// files outside of the base path are not part of the bundle.
+		{
+			`<script src="/other/main.js"></script>`,
+			`<script src="/other/main.js"></script>`,
+		},
+	}
+	for _, d := range testdata {
+		res, err := rewriter.Rewrite("/index.html", d.Content)
+		c.Check(err, IsNil, Commentf("%s", d.Content))
+		c.Check(res, Matches, d.Expected, Commentf("%s", d.Content))
+	}
+}
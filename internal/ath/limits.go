@@ -0,0 +1,120 @@
+package ath
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func validateServerLimits(config Config) error {
+	limits := config.Server
+	if limits.ReadHeaderTimeout < 0 || limits.ReadTimeout < 0 || limits.WriteTimeout < 0 || limits.IdleTimeout < 0 {
+		return errors.New("server timeouts must not be negative")
+	}
+	if limits.MaxHeaderBytes < 0 {
+		return errors.New("--server.max-header-bytes must not be negative")
+	}
+	if limits.MaxConnections < 0 {
+		return errors.New("--server.max-connections must not be negative")
+	}
+	return nil
+}
+
+// newHTTPServer returns a server for handler with the configured
+// timeouts and header size limit.
+func newHTTPServer(config Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		ReadTimeout:       config.Server.ReadTimeout,
+		WriteTimeout:      config.Server.WriteTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
+		MaxHeaderBytes:    int(config.Server.MaxHeaderBytes),
+	}
+}
+
+func limitHTTP3Server(config Config, server *http3.Server) {
+	server.MaxHeaderBytes = int(config.Server.MaxHeaderBytes)
+	server.QuicConfig = &quic.Config{
+		MaxIdleTimeout: config.Server.IdleTimeout,
+	}
+}
+
+// connectionLimiter bounds the number of connections open at once
+// across all the listeners it wraps.
+type connectionLimiter struct {
+	slots chan struct{}
+}
+
+// newConnectionLimiter returns nil, which does not limit anything,
+// if max is zero.
+func newConnectionLimiter(max int) *connectionLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connectionLimiter{slots: make(chan struct{}, max)}
+}
+
+func (l *connectionLimiter) wrap(listener net.Listener) net.Listener {
+	if l == nil {
+		return listener
+	}
+	return &limitedListener{
+		Listener: listener,
+		limiter:  l,
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *connectionLimiter) wrapAll(listeners []net.Listener) []net.Listener {
+	for i, listener := range listeners {
+		listeners[i] = l.wrap(listener)
+	}
+	return listeners
+}
+
+type limitedListener struct {
+	net.Listener
+	limiter *connectionLimiter
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Accept waits for a free slot before accepting a new connection,
+// leaving further clients in the kernel backlog.
+func (l *limitedListener) Accept() (net.Conn, error) {
+	select {
+	case l.limiter.slots <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.limiter.slots
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, release: func() { <-l.limiter.slots }}, nil
+}
+
+func (l *limitedListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+type limitedConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
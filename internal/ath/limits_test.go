@@ -0,0 +1,131 @@
+package ath
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type LimitsSuite struct{}
+
+var _ = Suite(&LimitsSuite{})
+
+func (s *LimitsSuite) TestDefaults(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{})
+	c.Assert(err, IsNil)
+	c.Check(validateServerLimits(config), IsNil)
+
+	server := newHTTPServer(config, nil)
+	c.Check(server.ReadHeaderTimeout, Equals, 10*time.Second)
+	c.Check(server.ReadTimeout, Equals, 30*time.Second)
+	c.Check(server.WriteTimeout, Equals, 60*time.Second)
+	c.Check(server.IdleTimeout, Equals, 120*time.Second)
+	c.Check(server.MaxHeaderBytes, Equals, 64*1024)
+	c.Check(config.Server.MaxConnections, Equals, 4096)
+
+	_, err = flags.ParseArgs(&config, []string{"--server.read-timeout", "-1s"})
+	c.Assert(err, IsNil)
+	c.Check(validateServerLimits(config), ErrorMatches, "server timeouts must not be negative")
+
+	_, err = flags.ParseArgs(&config, []string{"--server.read-timeout", "0s", "--server.max-connections", "-1"})
+	c.Assert(err, IsNil)
+	c.Check(validateServerLimits(config), ErrorMatches, "--server.max-connections must not be negative")
+}
+
+func (s *LimitsSuite) TestNoConnectionLimit(c *C) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer inner.Close()
+	var limiter *connectionLimiter = newConnectionLimiter(0)
+	c.Check(limiter, IsNil)
+	c.Check(limiter.wrap(inner), Equals, inner)
+}
+
+func (s *LimitsSuite) TestConnectionLimit(c *C) {
+	limiter := newConnectionLimiter(1)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	l := limiter.wrap(inner)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		c.Assert(err, IsNil)
+		defer conn.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		c.Fatalf("second connection accepted over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case second := <-accepted:
+		second.Close()
+	case <-time.After(time.Second):
+		c.Fatalf("second connection not accepted after the first was closed")
+	}
+}
+
+func (s *LimitsSuite) TestCloseUnblocksAccept(c *C) {
+	limiter := newConnectionLimiter(1)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	l := limiter.wrap(inner)
+	limiter.slots <- struct{}{}
+
+	errs := make(chan error)
+	go func() {
+		_, err := l.Accept()
+		errs <- err
+	}()
+	l.Close()
+	select {
+	case err := <-errs:
+		c.Check(err, Equals, net.ErrClosed)
+	case <-time.After(time.Second):
+		c.Fatalf("Accept not unblocked by Close")
+	}
+}
+
+func (s *LimitsSuite) TestReadHeaderTimeout(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"--server.read-header-timeout", "50ms"})
+	c.Assert(err, IsNil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	server := newHTTPServer(config, http.NotFoundHandler())
+	go server.Serve(l)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: slow\r\n")
+	c.Assert(err, IsNil)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadAll(conn)
+	// the server closes the connection instead of waiting forever.
+	c.Check(err, IsNil)
+}
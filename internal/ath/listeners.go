@@ -0,0 +1,201 @@
+package ath
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenAddresses returns the addresses to listen on, defaulting to
+// --address and --port.
+func listenAddresses(config Config) []string {
+	if len(config.Listen) > 0 {
+		return config.Listen
+	}
+	return []string{net.JoinHostPort(config.Address, strconv.Itoa(config.Port))}
+}
+
+func isSocketAddress(address string) bool {
+	return strings.HasPrefix(address, "unix:") || address == "systemd" || strings.HasPrefix(address, "systemd:")
+}
+
+// tcpListenAddresses returns the TCP addresses among the listen
+// addresses, and the port they share, or 0 if there are none.
+func tcpListenAddresses(config Config) ([]string, int, error) {
+	var res []string
+	port := 0
+	for _, address := range listenAddresses(config) {
+		if isSocketAddress(address) == true {
+			continue
+		}
+		_, service, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid listen address '%s': %w", address, err)
+		}
+		p, err := net.LookupPort("tcp", service)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid listen address '%s': %w", address, err)
+		}
+		if port != 0 && p != port {
+			return nil, 0, fmt.Errorf("listen addresses do not share a port, got %d and %d", port, p)
+		}
+		port = p
+		res = append(res, address)
+	}
+	return res, port, nil
+}
+
+func openListeners(config Config) (res []net.Listener, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, l := range res {
+			l.Close()
+		}
+		res = nil
+	}()
+
+	if config.Proxy.ProtocolOptional == true && config.Proxy.Protocol == false {
+		return nil, errors.New("--proxy.protocol-optional requires --proxy.protocol")
+	}
+	var trusted trustedProxies
+	if config.Proxy.Protocol == true {
+		if len(config.Proxy.Trusted) == 0 {
+			return nil, errors.New("--proxy.protocol requires --proxy.trusted")
+		}
+		if trusted, err = parseTrustedProxies(config.Proxy.Trusted); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, address := range listenAddresses(config) {
+		var listeners []net.Listener
+		switch {
+		case strings.HasPrefix(address, "unix:"):
+			var l net.Listener
+			l, err = listenUnix(strings.TrimPrefix(address, "unix:"), config)
+			listeners = []net.Listener{l}
+		case address == "systemd" || strings.HasPrefix(address, "systemd:"):
+			listeners, err = systemdListeners(strings.TrimPrefix(strings.TrimPrefix(address, "systemd"), ":"))
+		default:
+			var l net.Listener
+			l, err = net.Listen("tcp", address)
+			listeners = []net.Listener{l}
+		}
+		if err != nil {
+			return res, fmt.Errorf("listen on '%s': %w", address, err)
+		}
+		if config.Proxy.Protocol == true {
+			for i, l := range listeners {
+				listeners[i] = withProxyProtocol(l, trusted, config.Proxy.ProtocolOptional)
+			}
+		}
+		res = append(res, listeners...)
+	}
+	return res, nil
+}
+
+func listenUnix(path string, config Config) (net.Listener, error) {
+	mode, err := strconv.ParseUint(config.Unix.Mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --unix.mode '%s'", config.Unix.Mode)
+	}
+
+	uid, gid, err := lookupOwnership(config.Unix.Owner, config.Unix.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	// removes a stale socket from a previous run.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	res, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		res.Close()
+		return nil, err
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			res.Close()
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func lookupOwnership(owner, group string) (uid int, gid int, err error) {
+	uid, gid = -1, -1
+	if len(owner) > 0 {
+		if uid, err = strconv.Atoi(owner); err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return -1, -1, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if len(group) > 0 {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return -1, -1, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+const systemdFirstFD = 3
+
+// systemdListeners returns the sockets passed by systemd socket
+// activation, only the ones named name if not empty.
+func systemdListeners(name string) ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("no socket passed by systemd")
+	}
+	return activatedListeners(os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), name, systemdFirstFD)
+}
+
+func activatedListeners(fds, fdNames, name string, first int) ([]net.Listener, error) {
+	count, err := strconv.Atoi(fds)
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS '%s'", fds)
+	}
+	names := strings.Split(fdNames, ":")
+
+	res := []net.Listener{}
+	for i := 0; i < count; i++ {
+		fdName := ""
+		if i < len(names) {
+			fdName = names[i]
+		}
+		if len(name) > 0 && fdName != name {
+			continue
+		}
+		syscall.CloseOnExec(first + i)
+		file := os.NewFile(uintptr(first+i), fdName)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d: %w", i, err)
+		}
+		res = append(res, l)
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no socket named '%s' in LISTEN_FDNAMES '%s'", name, fdNames)
+	}
+	return res, nil
+}
@@ -0,0 +1,161 @@
+package ath
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type ListenersSuite struct{}
+
+var _ = Suite(&ListenersSuite{})
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func (s *ListenersSuite) TestAddresses(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"--port", "8080"})
+	c.Assert(err, IsNil)
+	c.Check(listenAddresses(config), DeepEquals, []string{"0.0.0.0:8080"})
+
+	_, err = flags.ParseArgs(&config, []string{"-l", "127.0.0.1:0", "-l", "unix:/run/app.sock"})
+	c.Assert(err, IsNil)
+	c.Check(listenAddresses(config), DeepEquals, []string{"127.0.0.1:0", "unix:/run/app.sock"})
+}
+
+func (s *ListenersSuite) TestUnixSocket(c *C) {
+	dir := c.MkDir()
+	socket := filepath.Join(dir, "app.sock")
+
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{
+		"-l", "unix:" + socket,
+		"-l", "127.0.0.1:0",
+		"--unix.mode", "0600",
+		"--unix.owner", strconv.Itoa(os.Getuid()),
+		"--unix.group", strconv.Itoa(os.Getgid()),
+	})
+	c.Assert(err, IsNil)
+
+	listeners, err := openListeners(config)
+	c.Assert(err, IsNil)
+	defer closeAll(listeners)
+	c.Assert(listeners, HasLen, 2)
+	c.Check(listeners[0].Addr().Network(), Equals, "unix")
+	c.Check(listeners[1].Addr().Network(), Equals, "tcp")
+
+	info, err := os.Stat(socket)
+	c.Assert(err, IsNil)
+	c.Check(info.Mode().Perm(), Equals, os.FileMode(0600))
+
+	go http.Serve(listeners[0], http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://unix/")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Check(string(body), Equals, "hello")
+}
+
+func (s *ListenersSuite) TestUnixSocketErrors(c *C) {
+	socket := filepath.Join(c.MkDir(), "app.sock")
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"-l", "unix:" + socket, "--unix.mode", "rw"})
+	c.Assert(err, IsNil)
+	_, err = openListeners(config)
+	c.Check(err, ErrorMatches, "listen on 'unix:.*': invalid --unix.mode 'rw'")
+
+	config.Unix.Mode = "0660"
+	config.Unix.Owner = "no-such-user-for-sure"
+	_, err = openListeners(config)
+	c.Check(err, ErrorMatches, "listen on 'unix:.*': user: unknown user no-such-user-for-sure")
+
+	config.Unix.Owner = ""
+	config.Listen = []string{"unix:" + socket, "systemd"}
+	_, err = openListeners(config)
+	c.Check(err, ErrorMatches, "listen on 'systemd': no socket passed by systemd")
+	// the unix socket was closed and removed.
+	_, err = os.Stat(socket)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *ListenersSuite) TestSocketActivation(c *C) {
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer first.Close()
+	second, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer second.Close()
+
+	// simulates systemd passing two consecutive file descriptors.
+	base := 100
+	for i, l := range []net.Listener{first, second} {
+		file, err := l.(*net.TCPListener).File()
+		c.Assert(err, IsNil)
+		c.Assert(syscall.Dup2(int(file.Fd()), base+i), IsNil)
+		file.Close()
+	}
+
+	listeners, err := activatedListeners("2", "http:admin", "admin", base)
+	c.Assert(err, IsNil)
+	c.Assert(listeners, HasLen, 1)
+	c.Check(listeners[0].Addr().String(), Equals, second.Addr().String())
+	closeAll(listeners)
+
+	_, err = activatedListeners("2", "http:admin", "other", base)
+	c.Check(err, ErrorMatches, "no socket named 'other' in LISTEN_FDNAMES 'http:admin'")
+
+	_, err = activatedListeners("", "", "", base)
+	c.Check(err, ErrorMatches, "invalid LISTEN_FDS ''")
+
+	file, err := first.(*net.TCPListener).File()
+	c.Assert(err, IsNil)
+	c.Assert(syscall.Dup2(int(file.Fd()), base), IsNil)
+	file.Close()
+	listeners, err = activatedListeners("1", "", "", base)
+	c.Assert(err, IsNil)
+	c.Assert(listeners, HasLen, 1)
+	c.Check(listeners[0].Addr().String(), Equals, first.Addr().String())
+	closeAll(listeners)
+}
+
+func (s *ListenersSuite) TestProxyProtocolRequiresTrusted(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"-l", "127.0.0.1:0", "--proxy.protocol"})
+	c.Assert(err, IsNil)
+	_, err = openListeners(config)
+	c.Check(err, ErrorMatches, "--proxy.protocol requires --proxy.trusted")
+
+	var optional Config
+	_, err = flags.ParseArgs(&optional, []string{"-l", "127.0.0.1:0", "--proxy.protocol-optional"})
+	c.Assert(err, IsNil)
+	_, err = openListeners(optional)
+	c.Check(err, ErrorMatches, "--proxy.protocol-optional requires --proxy.protocol")
+
+	_, err = flags.ParseArgs(&config, []string{"-l", "127.0.0.1:0", "--proxy.protocol", "--proxy.trusted", "127.0.0.1"})
+	c.Assert(err, IsNil)
+	listeners, err := openListeners(config)
+	c.Assert(err, IsNil)
+	defer closeAll(listeners)
+	c.Check(listeners[0], FitsTypeOf, &proxyProtocolListener{})
+}
@@ -2,8 +2,8 @@ package ath
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
 	"sort"
@@ -14,8 +14,10 @@ import (
 	"github.com/jessevdk/go-flags"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
@@ -175,25 +177,108 @@ func Execute() error {
 		}
 	}
 
-	routes, err := BuildRoutes(config)
+	var routes map[string]Route
+	var handler http.Handler
+	var err error
+	if len(config.Sites) > 0 {
+		routes, handler, err = buildSites(config)
+	} else {
+		routes, handler, err = buildHandler(config, nil)
+	}
 	if err != nil {
 		return err
 	}
 
 	go printRoutes(routes)
 
-	listen, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.Address, config.Port))
-	if err != nil {
-		return err
-	}
-
-	handler := otelhttp.NewHandler(NewHandler(routes), "",
+	handler = otelhttp.NewHandler(handler, "",
 		otelhttp.WithSpanNameFormatter(
 			func(operation string, req *http.Request) string {
 				return req.RequestURI
 			}),
 	)
-	return http.Serve(listen, handler)
+	return listenAndServe(config, handler)
+}
+
+// buildHandler builds the routes of the application described by
+// config, and the Handler serving them.
+func buildHandler(config Config, budget *memoryBudget, options ...HandlerOption) (map[string]Route, *Handler, error) {
+	builder, err := newRouteBuilder(config, budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	routes, err := builder.build()
+	if err != nil {
+		return nil, nil, err
+	}
+	errorPages, err := builder.buildErrorPages()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	securityHeaders, err := loadSecurityHeaders(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	locales, err := loadLocales(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	basePath, err := parseBaseHref(config.BaseHref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options = append([]HandlerOption{
+		WithSecurityHeaders(securityHeaders),
+		WithLocales(locales),
+		WithBaseHref(basePath, config.StripBaseHref),
+		WithErrorPages(errorPages),
+	}, options...)
+	for _, pattern := range config.Fallback.Exclude {
+		if err := validateGlob(pattern); err != nil {
+			return nil, nil, err
+		}
+	}
+	options = append(options, WithFallbackRules(config.Fallback.AllowExtensions, config.Fallback.Exclude))
+
+	if len(config.TLS.ClientCA) > 0 {
+		for _, pattern := range config.TLS.ClientAuthExempt {
+			if err := validateGlob(pattern); err != nil {
+				return nil, nil, err
+			}
+		}
+		options = append(options, WithClientAuth(config.TLS.ClientAuthExempt))
+	}
+
+	if err := validateRateLimits(config); err != nil {
+		return nil, nil, err
+	}
+	options = append(options, WithRateLimits(map[string]RateLimit{
+		"nonced":    config.RateLimit.Nonced,
+		"static":    config.RateLimit.Static,
+		"immutable": config.RateLimit.Immutable,
+	}, config.RateLimit.MaxClients))
+
+	mounts, err := loadMounts(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	options = append(options, WithMounts(mounts))
+
+	rules, err := loadRules(config.Rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	options = append(options, WithRules(rules))
+
+	handler := NewHandler(routes, options...)
+	if err := handler.validateRewrites(); err != nil {
+		return nil, nil, fmt.Errorf("'%s': %w", config.Rules, err)
+	}
+	return routes, handler, nil
 }
 
 func setTelemetry(config Config) (func(context.Context) error, error) {
@@ -208,12 +293,26 @@ func setTelemetry(config Config) (func(context.Context) error, error) {
 		return noop, nil
 	}
 
+	// both exporters are created before installing any provider, so
+	// that a failure leaves nothing running.
+	metricExporter, err := otlpmetricgrpc.New(context.Background(),
+		otlpmetricgrpc.WithEndpoint(config.Otel.Endpoint),
+		otlpmetricgrpc.WithInsecure(),
+	)
+	if err != nil {
+		return noop, errors.Join(err, exporter.Shutdown(context.Background()))
+	}
+	shutdownExporters := func(err error) (func(context.Context) error, error) {
+		ctx := context.Background()
+		return noop, errors.Join(err, exporter.Shutdown(ctx), metricExporter.Shutdown(ctx))
+	}
+
 	instanceID := config.Otel.ServiceInstanceID
 	if len(instanceID) == 0 {
 		var err error
 		instanceID, err = os.Hostname()
 		if err != nil {
-			return noop, err
+			return shutdownExporters(err)
 		}
 	}
 
@@ -227,7 +326,7 @@ func setTelemetry(config Config) (func(context.Context) error, error) {
 		),
 	)
 	if err != nil {
-		return noop, err
+		return shutdownExporters(err)
 	}
 
 	provider := trace.NewTracerProvider(
@@ -242,7 +341,15 @@ func setTelemetry(config Config) (func(context.Context) error, error) {
 			propagation.Baggage{},
 		))
 
-	return exporter.Shutdown, nil
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
+		sdkmetric.WithResource(resource),
+	)
+	otel.SetMeterProvider(meterProvider)
+
+	return func(ctx context.Context) error {
+		return errors.Join(exporter.Shutdown(ctx), meterProvider.Shutdown(ctx))
+	}, nil
 }
 
 func mapLogLevel(level int) zapcore.Level {
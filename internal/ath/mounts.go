@@ -0,0 +1,342 @@
+package ath
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.uber.org/zap"
+)
+
+// HeaderRewrite sets or removes headers of proxied requests or
+// responses.
+type HeaderRewrite struct {
+	Set    map[string]string `json:"set"`
+	Remove []string          `json:"remove"`
+}
+
+func (r HeaderRewrite) validate() error {
+	for name := range r.Set {
+		if headerNameRx.MatchString(name) == false {
+			return fmt.Errorf("invalid header name '%s'", name)
+		}
+	}
+	for _, name := range r.Remove {
+		if headerNameRx.MatchString(name) == false {
+			return fmt.Errorf("invalid header name '%s'", name)
+		}
+	}
+	return nil
+}
+
+func (r HeaderRewrite) apply(header http.Header) {
+	for _, name := range r.Remove {
+		header.Del(name)
+	}
+	for name, value := range r.Set {
+		header.Set(name, value)
+	}
+}
+
+// MountConfig forwards the requests under a path to an upstream
+// server.
+type MountConfig struct {
+	Path     string `json:"path"`
+	Upstream string `json:"upstream"`
+	// StripPath removes Path from forwarded requests.
+	StripPath bool `json:"strip-path"`
+	// PreserveHost forwards the Host header of the client, instead of
+	// the upstream host.
+	PreserveHost bool `json:"preserve-host"`
+
+	RequestHeaders  HeaderRewrite `json:"request-headers"`
+	ResponseHeaders HeaderRewrite `json:"response-headers"`
+
+	ConnectTimeout  Duration `json:"connect-timeout"`
+	ResponseTimeout Duration `json:"response-timeout"`
+	IdleTimeout     Duration `json:"idle-timeout"`
+}
+
+type MountsConfig struct {
+	Mounts []MountConfig `json:"mounts"`
+}
+
+// UnmarshalFlag parses '<path>=<upstream>'.
+func (c *MountConfig) UnmarshalFlag(value string) error {
+	path, upstream, ok := strings.Cut(value, "=")
+	if ok == false {
+		return fmt.Errorf("invalid mount '%s', expected '<path>=<upstream URL>'", value)
+	}
+	c.Path = strings.TrimSpace(path)
+	c.Upstream = strings.TrimSpace(upstream)
+	return nil
+}
+
+func (c MountConfig) MarshalFlag() (string, error) {
+	return c.Path + "=" + c.Upstream, nil
+}
+
+const (
+	defaultConnectTimeout  = 10 * time.Second
+	defaultResponseTimeout = 60 * time.Second
+	defaultIdleTimeout     = 90 * time.Second
+)
+
+type mount struct {
+	MountConfig
+	// prefix is Path without trailing slash.
+	prefix   string
+	upstream *url.URL
+	proxy    *httputil.ReverseProxy
+}
+
+// mountRequest is the state of a forwarded request, passed to the
+// proxy of its mount through the request context.
+type mountRequest struct {
+	// path is the path requested by the client, forwarded the escaped
+	// path sent to the upstream.
+	path, forwarded string
+	errorWriter     http.ResponseWriter
+	securityHeaders SecurityHeadersConfig
+}
+
+type mountRequestKey struct{}
+
+func getMountRequest(req *http.Request) *mountRequest {
+	return req.Context().Value(mountRequestKey{}).(*mountRequest)
+}
+
+func newMount(config MountConfig) (*mount, error) {
+	if strings.HasPrefix(config.Path, "/") == false {
+		return nil, fmt.Errorf("invalid mount path '%s', expected an absolute path", config.Path)
+	}
+	upstream, err := url.Parse(config.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream '%s': %w", config.Upstream, err)
+	}
+	if (upstream.Scheme != "http" && upstream.Scheme != "https") || len(upstream.Host) == 0 {
+		return nil, fmt.Errorf("invalid upstream '%s', expected an http:// or https:// URL", config.Upstream)
+	}
+	if err := config.RequestHeaders.validate(); err != nil {
+		return nil, fmt.Errorf("mount '%s': request headers: %w", config.Path, err)
+	}
+	if err := config.ResponseHeaders.validate(); err != nil {
+		return nil, fmt.Errorf("mount '%s': response headers: %w", config.Path, err)
+	}
+
+	durationOr := func(d Duration, defaultValue time.Duration) time.Duration {
+		if d == 0 {
+			return defaultValue
+		}
+		return time.Duration(d)
+	}
+	dialer := &net.Dialer{
+		Timeout:   durationOr(config.ConnectTimeout, defaultConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       durationOr(config.IdleTimeout, defaultIdleTimeout),
+		TLSHandshakeTimeout:   durationOr(config.ConnectTimeout, defaultConnectTimeout),
+		ResponseHeaderTimeout: durationOr(config.ResponseTimeout, defaultResponseTimeout),
+		ExpectContinueTimeout: time.Second,
+	}
+
+	m := &mount{
+		MountConfig: config,
+		prefix:      strings.TrimSuffix(config.Path, "/"),
+		upstream:    upstream,
+	}
+	m.proxy = &httputil.ReverseProxy{
+		// propagates the trace context of the otelhttp server span.
+		Transport:      otelhttp.NewTransport(transport),
+		Rewrite:        m.rewrite,
+		ModifyResponse: m.modifyResponse,
+		ErrorHandler:   m.handleError,
+	}
+	return m, nil
+}
+
+// cleanEscapedPath resolves the dot segments of the escaped path p,
+// including percent-encoded ones, so that a mount path can not be
+// escaped. Other segments, and their encoded slashes, are kept as is.
+func cleanEscapedPath(p string) (string, error) {
+	segments := strings.Split(p, "/")
+	res := make([]string, 0, len(segments))
+	trailing := false
+	for _, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", err
+		}
+		trailing = true
+		switch decoded {
+		case "", ".":
+		case "..":
+			if len(res) > 0 {
+				res = res[:len(res)-1]
+			}
+		default:
+			res = append(res, segment)
+			trailing = false
+		}
+	}
+	if len(res) == 0 {
+		return "/", nil
+	}
+	if trailing == true {
+		return "/" + strings.Join(res, "/") + "/", nil
+	}
+	return "/" + strings.Join(res, "/"), nil
+}
+
+// match reports if the cleaned escaped path p is under the mount.
+func (m *mount) match(p string) bool {
+	return p == m.prefix || strings.HasPrefix(p, m.prefix+"/")
+}
+
+// serve forwards req, whose cleaned escaped path is p, to the
+// upstream, writing its response to w and proxy errors to
+// errorWriter. Security headers are only added to responses if the
+// upstream does not set them.
+//
+// The read and write deadlines of the server do not apply to
+// forwarded requests, so that uploads and long responses such as
+// Server-Sent Events are not cut off, and ResponseTimeout can
+// expire. The upstream bounds them instead.
+func (m *mount) serve(w, errorWriter http.ResponseWriter, req *http.Request, p string, securityHeaders SecurityHeadersConfig) {
+	forwarded := p
+	if m.StripPath == true {
+		forwarded = strings.TrimPrefix(p, m.prefix)
+		if len(forwarded) == 0 {
+			forwarded = "/"
+		}
+	}
+
+	controller := http.NewResponseController(w)
+	for _, setDeadline := range []func(time.Time) error{controller.SetReadDeadline, controller.SetWriteDeadline} {
+		if err := setDeadline(time.Time{}); err != nil && errors.Is(err, http.ErrNotSupported) == false {
+			zap.L().Warn("could not clear deadline", zap.String("mount", m.Path), zap.Error(err))
+		}
+	}
+
+	ctx := context.WithValue(req.Context(), mountRequestKey{}, &mountRequest{
+		path:            req.URL.Path,
+		forwarded:       forwarded,
+		errorWriter:     errorWriter,
+		securityHeaders: securityHeaders,
+	})
+	m.proxy.ServeHTTP(w, req.WithContext(ctx))
+}
+
+func (m *mount) rewrite(r *httputil.ProxyRequest) {
+	forwarded := getMountRequest(r.In).forwarded
+	// forwarded is a valid escaped path, checked by cleanEscapedPath.
+	r.Out.URL.Path, _ = url.PathUnescape(forwarded)
+	r.Out.URL.RawPath = forwarded
+	r.SetURL(m.upstream)
+	if m.PreserveHost == true {
+		r.Out.Host = r.In.Host
+	}
+	// the client address and scheme are already resolved from trusted
+	// proxies.
+	r.Out.Header.Set("X-Forwarded-For", hostOnly(r.In.RemoteAddr))
+	r.Out.Header.Set("X-Forwarded-Host", r.In.Host)
+	r.Out.Header.Set("X-Forwarded-Proto", requestScheme(r.In))
+	m.RequestHeaders.apply(r.Out.Header)
+}
+
+func (m *mount) modifyResponse(resp *http.Response) error {
+	m.ResponseHeaders.apply(resp.Header)
+	defaults := make(http.Header)
+	state := getMountRequest(resp.Request)
+	state.securityHeaders.Apply(defaults, state.path)
+	for name, values := range defaults {
+		if _, ok := resp.Header[name]; ok == false {
+			resp.Header[name] = values
+		}
+	}
+	return nil
+}
+
+func (m *mount) handleError(_ http.ResponseWriter, req *http.Request, err error) {
+	status := http.StatusBadGateway
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) == true ||
+		(errors.As(err, &netErr) == true && netErr.Timeout() == true) {
+		status = http.StatusGatewayTimeout
+	}
+	zap.L().Warn("upstream error",
+		zap.String("mount", m.Path),
+		zap.String("upstream", m.Upstream),
+		zap.String("URL", req.URL.String()),
+		zap.Int("status", status),
+		zap.Error(err))
+	errorWriter := getMountRequest(req).errorWriter
+	http.Error(errorWriter, http.StatusText(status), status)
+}
+
+// mounts are matched on request paths before any other handling, by
+// decreasing path length.
+type mounts []*mount
+
+func newMounts(configs []MountConfig) (mounts, error) {
+	res := make(mounts, 0, len(configs))
+	paths := make(map[string]bool)
+	for _, config := range configs {
+		m, err := newMount(config)
+		if err != nil {
+			return nil, err
+		}
+		if paths[m.prefix] == true {
+			return nil, fmt.Errorf("duplicate mount '%s'", config.Path)
+		}
+		paths[m.prefix] = true
+		res = append(res, m)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return len(res[i].prefix) > len(res[j].prefix)
+	})
+	return res, nil
+}
+
+// loadMounts returns the mounts of --mount and of the --mounts file.
+func loadMounts(config Config) (mounts, error) {
+	configs := append([]MountConfig(nil), config.Mount...)
+	if len(config.Mounts) > 0 {
+		file := MountsConfig{}
+		if err := loadJSONFile(config.Mounts, &file); err != nil {
+			return nil, err
+		}
+		configs = append(configs, file.Mounts...)
+	}
+	return newMounts(configs)
+}
+
+func (m mounts) match(p string) *mount {
+	for _, mount := range m {
+		if mount.match(p) == true {
+			return mount
+		}
+	}
+	return nil
+}
+
+// WithMounts forwards requests under the path of mounts to their
+// upstream.
+func WithMounts(mounts mounts) HandlerOption {
+	return func(h *Handler) {
+		h.mounts = mounts
+	}
+}
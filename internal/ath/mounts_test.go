@@ -0,0 +1,299 @@
+package ath
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type MountsSuite struct{}
+
+var _ = Suite(&MountsSuite{})
+
+func (s *MountsSuite) TestParse(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"--mount", "/api/=http://localhost:8080"})
+	c.Assert(err, IsNil)
+	c.Assert(config.Mount, HasLen, 1)
+	c.Check(config.Mount[0].Path, Equals, "/api/")
+	c.Check(config.Mount[0].Upstream, Equals, "http://localhost:8080")
+
+	_, err = flags.ParseArgs(&config, []string{"--mount", "/api/"})
+	c.Check(err, ErrorMatches, ".*invalid mount '/api/', expected '<path>=<upstream URL>'")
+
+	testdata := []struct {
+		Config MountConfig
+		Error  string
+	}{
+		{MountConfig{Path: "api", Upstream: "http://localhost"}, "invalid mount path 'api', expected an absolute path"},
+		{MountConfig{Path: "/api", Upstream: "localhost:8080"}, "invalid upstream 'localhost:8080', expected an http:// or https:// URL"},
+		{MountConfig{Path: "/api", Upstream: "ws://localhost"}, "invalid upstream 'ws://localhost', expected an http:// or https:// URL"},
+		{MountConfig{Path: "/api", Upstream: "http://localhost",
+			RequestHeaders: HeaderRewrite{Set: map[string]string{"Bad Header": "x"}}},
+			"mount '/api': request headers: invalid header name 'Bad Header'"},
+	}
+	for _, d := range testdata {
+		_, err := newMount(d.Config)
+		c.Check(err, ErrorMatches, d.Error)
+	}
+
+	_, err = newMounts([]MountConfig{
+		{Path: "/api/", Upstream: "http://a"},
+		{Path: "/api", Upstream: "http://b"},
+	})
+	c.Check(err, ErrorMatches, "duplicate mount '/api'")
+
+	dir := c.MkDir()
+	path := filepath.Join(dir, "mounts.json")
+	c.Assert(os.WriteFile(path, []byte(`{"mounts":[
+{"path":"/api/v2/","upstream":"http://v2","strip-path":true,"response-timeout":"5s"}
+]}`), 0644), IsNil)
+	_, err = flags.ParseArgs(&config, []string{"--mount", "/api/=http://v1", "--mounts", path})
+	c.Assert(err, IsNil)
+	mounts, err := loadMounts(config)
+	c.Assert(err, IsNil)
+	c.Assert(mounts, HasLen, 2)
+	c.Check(mounts.match("/api/v2/users").Upstream, Equals, "http://v2")
+	c.Check(mounts.match("/api/v1/users").Upstream, Equals, "http://v1")
+	c.Check(mounts.match("/api").Upstream, Equals, "http://v1")
+	c.Check(mounts.match("/apis"), IsNil)
+	c.Check(mounts[0].ResponseTimeout, Equals, Duration(5*time.Second))
+
+	c.Assert(os.WriteFile(path, []byte(`{"mounts":[{"path":"/api/","upstream":"http://v2","idle-timeout":30}]}`), 0644), IsNil)
+	_, err = loadMounts(config)
+	c.Check(err, ErrorMatches, `parsing '.*mounts.json': invalid duration 30, expected a string such as "30s"`)
+}
+
+func (s *MountsSuite) TestCleanEscapedPath(c *C) {
+	testdata := []struct {
+		Path, Expected string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/api/users", "/api/users"},
+		{"/api/users/", "/api/users/"},
+		{"/api//users/./", "/api/users/"},
+		{"/api/../admin", "/admin"},
+		{"/api/%2e%2E/admin", "/admin"},
+		{"/api/..", "/"},
+		{"/../../admin", "/admin"},
+		{"/api/a%2Fb", "/api/a%2Fb"},
+		{"/api/..%2Fadmin", "/api/..%2Fadmin"},
+	}
+	for _, d := range testdata {
+		p, err := cleanEscapedPath(d.Path)
+		c.Check(err, IsNil)
+		c.Check(p, Equals, d.Expected, Commentf("path: %s", d.Path))
+	}
+	_, err := cleanEscapedPath("/api/%zz")
+	c.Check(err, NotNil)
+}
+
+func (s *MountsSuite) TestProxy(c *C) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Path", req.URL.Path)
+		w.Header().Set("X-Raw-Path", req.URL.EscapedPath())
+		w.Header().Set("X-Query", req.URL.RawQuery)
+		w.Header().Set("X-Host", req.Host)
+		w.Header().Set("X-Forwarded", req.Header.Get("X-Forwarded-For")+" "+
+			req.Header.Get("X-Forwarded-Host")+" "+req.Header.Get("X-Forwarded-Proto"))
+		w.Header().Set("X-Token", req.Header.Get("X-Token"))
+		w.Header().Set("X-Cookie", req.Header.Get("Cookie"))
+		w.Header().Set("Server", "upstream")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		if req.URL.Path == "/missing" || req.URL.Path == "/api/missing" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		w.Write([]byte(req.Method))
+	}))
+	defer upstream.Close()
+
+	mounts, err := newMounts([]MountConfig{
+		{Path: "/api/", Upstream: upstream.URL, StripPath: true,
+			RequestHeaders:  HeaderRewrite{Set: map[string]string{"X-Token": "secret"}, Remove: []string{"Cookie"}},
+			ResponseHeaders: HeaderRewrite{Remove: []string{"Server"}}},
+		{Path: "/raw", Upstream: upstream.URL + "/base", PreserveHost: true},
+	})
+	c.Assert(err, IsNil)
+
+	errorPage := writeBundle(c, map[string]string{"404.html": "<p>not found</p>"})
+	pages, err := (&routeBuilder{root: errorPage, sized: NewCache(-1), permanent: NewCache(-1)}).buildErrorPages()
+	c.Assert(err, IsNil)
+	h := NewHandler(nil, WithMounts(mounts), WithErrorPages(pages),
+		WithSecurityHeaders(SecurityHeadersConfig{Headers: map[string]string{
+			"Referrer-Policy":        "same-origin",
+			"X-Content-Type-Options": "nosniff",
+		}}))
+
+	req := httptest.NewRequest("POST", "/api/users?page=2", strings.NewReader("{}"))
+	req.Host = "app.example.com"
+	req.RemoteAddr = "192.0.2.1:4321"
+	req.Header.Set("Cookie", "session=1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.String(), Equals, "POST")
+	c.Check(w.Header().Get("X-Path"), Equals, "/users")
+	c.Check(w.Header().Get("X-Query"), Equals, "page=2")
+	c.Check(w.Header().Get("X-Host"), Equals, strings.TrimPrefix(upstream.URL, "http://"))
+	c.Check(w.Header().Get("X-Forwarded"), Equals, "192.0.2.1 app.example.com http")
+	c.Check(w.Header().Get("X-Token"), Equals, "secret")
+	c.Check(w.Header().Get("X-Cookie"), Equals, "")
+	c.Check(w.Header().Get("Server"), Equals, "")
+	// the upstream security headers win.
+	c.Check(w.Header().Values("Referrer-Policy"), DeepEquals, []string{"no-referrer"})
+	c.Check(w.Header().Get("X-Content-Type-Options"), Equals, "nosniff")
+
+	req = httptest.NewRequest("GET", "/raw/missing", nil)
+	req.Host = "app.example.com"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Header().Get("X-Path"), Equals, "/base/raw/missing")
+	c.Check(w.Header().Get("X-Host"), Equals, "app.example.com")
+
+	// encoded slashes are kept when stripping the mount path.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/a%2Fb", nil))
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Header().Get("X-Path"), Equals, "/a/b")
+	c.Check(w.Header().Get("X-Raw-Path"), Equals, "/a%2Fb")
+
+	// dot segments can not escape the mount path.
+	for _, target := range []string{"/api/../admin", "/api/%2E%2E/admin", "/api/users/../../admin"} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		c.Check(w.Header().Get("X-Path"), Equals, "", Commentf("target: %s", target))
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/users/../groups", nil))
+	c.Check(w.Header().Get("X-Path"), Equals, "/groups")
+
+	// upstream errors are not replaced by error pages.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/missing", nil))
+	c.Check(w.Code, Equals, http.StatusNotFound)
+	c.Check(w.Body.String(), Equals, `{"error":"not found"}`)
+}
+
+func (s *MountsSuite) TestUpstreamErrors(c *C) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	mounts, err := newMounts([]MountConfig{
+		{Path: "/slow", Upstream: slow.URL, ResponseTimeout: Duration(20 * time.Millisecond)},
+		{Path: "/closed", Upstream: closed.URL},
+	})
+	c.Assert(err, IsNil)
+	dir := writeBundle(c, map[string]string{"502.html": "<p>bad gateway</p>"})
+	pages, err := (&routeBuilder{root: dir, sized: NewCache(-1), permanent: NewCache(-1)}).buildErrorPages()
+	c.Assert(err, IsNil)
+	h := NewHandler(nil, WithMounts(mounts), WithErrorPages(pages))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	c.Check(w.Code, Equals, http.StatusGatewayTimeout)
+	c.Check(w.Body.String(), Equals, "Gateway Timeout\n")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/closed/x", nil))
+	c.Check(w.Code, Equals, http.StatusBadGateway)
+	c.Check(w.Body.String(), Equals, "<p>bad gateway</p>")
+}
+
+func (s *MountsSuite) TestWebSocket(c *C) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		rw.Flush()
+		// echoes a line.
+		line, _ := rw.ReadString('\n')
+		rw.WriteString("echo: " + line)
+		rw.Flush()
+	}))
+	defer upstream.Close()
+
+	mounts, err := newMounts([]MountConfig{{Path: "/ws", Upstream: upstream.URL}})
+	c.Assert(err, IsNil)
+	dir := writeBundle(c, map[string]string{"404.html": "<p>not found</p>"})
+	pages, err := (&routeBuilder{root: dir, sized: NewCache(-1), permanent: NewCache(-1)}).buildErrorPages()
+	c.Assert(err, IsNil)
+	server := httptest.NewServer(NewHandler(nil, WithMounts(mounts), WithErrorPages(pages)))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	c.Assert(err, IsNil)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	c.Assert(err, IsNil)
+	c.Check(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+
+	_, err = io.WriteString(conn, "hello\n")
+	c.Assert(err, IsNil)
+	line, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Check(line, Equals, "echo: hello\n")
+}
+
+func (s *MountsSuite) TestServerTimeouts(c *C) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		time.Sleep(300 * time.Millisecond)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	mounts, err := newMounts([]MountConfig{{Path: "/api", Upstream: upstream.URL}})
+	c.Assert(err, IsNil)
+	var config Config
+	config.Server.ReadTimeout = 100 * time.Millisecond
+	config.Server.WriteTimeout = 100 * time.Millisecond
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = newHTTPServer(config, NewHandler(nil, WithMounts(mounts)))
+	server.Start()
+	defer server.Close()
+
+	// the body is sent after the read timeout.
+	body, writer := io.Pipe()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(writer, "upload")
+		writer.Close()
+	}()
+	resp, err := http.Post(server.URL+"/api/upload", "text/plain", body)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	data, err := io.ReadAll(resp.Body)
+	c.Check(err, IsNil)
+	c.Check(string(data), Equals, "upload")
+}
@@ -0,0 +1,118 @@
+package ath
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultNonceLength = 32
+	minNonceLength     = 16
+)
+
+// nonceSource provides base64 encoded random nonces.
+type nonceSource interface {
+	Nonce() (string, error)
+}
+
+// randomNonces generates each nonce on demand.
+type randomNonces struct {
+	length int
+}
+
+func (s randomNonces) Nonce() (string, error) {
+	nonce := make([]byte, s.length)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce), nil
+}
+
+func newNonceSource(length, poolSize int) (nonceSource, error) {
+	if length < minNonceLength {
+		return nil, fmt.Errorf("nonce length must be at least %d bytes, got %d", minNonceLength, length)
+	}
+	if poolSize < 0 {
+		return nil, fmt.Errorf("nonce pool size must not be negative, got %d", poolSize)
+	}
+	if poolSize == 0 {
+		return randomNonces{length: length}, nil
+	}
+	return newNoncePool(randomNonces{length: length}, poolSize), nil
+}
+
+// noncePool holds nonces generated in the background, so that bursts
+// of requests do not wait on the entropy source. Each nonce is
+// received from a channel, and therefore used only once. When the
+// pool is depleted, nonces are generated on demand. Pools are built
+// with their routes and filled for the lifetime of the process.
+type noncePool struct {
+	source randomNonces
+	nonces chan string
+
+	depletedCounter metric.Int64Counter
+}
+
+func newNoncePool(source randomNonces, size int) *noncePool {
+	res := &noncePool{
+		source: source,
+		nonces: make(chan string, size),
+	}
+	res.registerMetrics()
+	go res.fill()
+	return res
+}
+
+func (p *noncePool) registerMetrics() {
+	meter := otel.Meter("github.com/atuleu/angular-to-http")
+	var err error
+	p.depletedCounter, err = meter.Int64Counter("ath.nonce_pool.depleted",
+		metric.WithDescription("nonces generated on demand because the pool was empty"))
+	if err != nil {
+		zap.L().Warn("could not create nonce pool metric", zap.Error(err))
+	}
+	available, err := meter.Int64ObservableGauge("ath.nonce_pool.available",
+		metric.WithDescription("nonces available in the pool"))
+	if err != nil {
+		zap.L().Warn("could not create nonce pool metric", zap.Error(err))
+		return
+	}
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		o.ObserveInt64(available, int64(len(p.nonces)))
+		return nil
+	}, available)
+	if err != nil {
+		zap.L().Warn("could not register nonce pool metric", zap.Error(err))
+	}
+}
+
+func (p *noncePool) fill() {
+	for {
+		nonce, err := p.source.Nonce()
+		if err != nil {
+			zap.L().Error("could not generate nonce for the pool", zap.Error(err))
+			time.Sleep(time.Second)
+			continue
+		}
+		p.nonces <- nonce
+	}
+}
+
+func (p *noncePool) Nonce() (string, error) {
+	select {
+	case nonce := <-p.nonces:
+		return nonce, nil
+	default:
+	}
+	if p.depletedCounter != nil {
+		p.depletedCounter.Add(context.Background(), 1)
+	}
+	return p.source.Nonce()
+}
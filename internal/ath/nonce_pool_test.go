@@ -0,0 +1,119 @@
+package ath
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type NoncePoolSuite struct{}
+
+var _ = Suite(&NoncePoolSuite{})
+
+func (s *NoncePoolSuite) TestNonceSource(c *C) {
+	_, err := newNonceSource(8, 0)
+	c.Check(err, ErrorMatches, "nonce length must be at least 16 bytes, got 8")
+	_, err = newNonceSource(32, -1)
+	c.Check(err, ErrorMatches, "nonce pool size must not be negative, got -1")
+
+	source, err := newNonceSource(24, 0)
+	c.Assert(err, IsNil)
+	c.Check(source, FitsTypeOf, randomNonces{})
+	nonce, err := source.Nonce()
+	c.Assert(err, IsNil)
+	decoded, err := base64.RawURLEncoding.DecodeString(nonce)
+	c.Check(err, IsNil)
+	c.Check(decoded, HasLen, 24)
+
+	source, err = newNonceSource(16, 4)
+	c.Assert(err, IsNil)
+	nonce, err = source.Nonce()
+	c.Assert(err, IsNil)
+	decoded, err = base64.RawURLEncoding.DecodeString(nonce)
+	c.Check(err, IsNil)
+	c.Check(decoded, HasLen, 16)
+}
+
+func waitFilled(c *C, pool *noncePool) {
+	deadline := time.Now().Add(time.Second)
+	for len(pool.nonces) < cap(pool.nonces) {
+		if time.Now().After(deadline) {
+			c.Fatalf("pool was not filled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *NoncePoolSuite) TestSingleUse(c *C) {
+	pool := newNoncePool(randomNonces{length: 32}, 16)
+	waitFilled(c, pool)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		nonce, err := pool.Nonce()
+		c.Assert(err, IsNil)
+		c.Check(seen[nonce], Equals, false)
+		seen[nonce] = true
+	}
+}
+
+func (s *NoncePoolSuite) TestDepletion(c *C) {
+	// a pool that is not filled in the background.
+	pool := &noncePool{source: randomNonces{length: 32}, nonces: make(chan string, 4)}
+	for i := 0; i < 4; i++ {
+		pool.nonces <- "pooled"
+	}
+
+	for i := 0; i < 4; i++ {
+		nonce, err := pool.Nonce()
+		c.Assert(err, IsNil)
+		c.Check(nonce, Equals, "pooled")
+	}
+
+	nonce, err := pool.Nonce()
+	c.Check(err, IsNil)
+	c.Check(nonce, HasLen, 43)
+}
+
+type fixedNonce string
+
+func (n fixedNonce) Nonce() (string, error) {
+	return string(n), nil
+}
+
+func (s *NoncePoolSuite) TestRouteUsesSource(c *C) {
+	templ := template.Must(template.New("CSP").Parse(`script-src 'nonce-{{.Nonce}}'`))
+	templ = template.Must(templ.New("content").Parse(`<script nonce="{{.Nonce}}"></script>`))
+	r := NoncedRoute{
+		route:    route{"index.html", "text/html; charset=utf-8", nil},
+		template: templ,
+		nonces:   fixedNonce("fixed"),
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/index.html", nil))
+	c.Check(w.Header().Get("Content-Security-Policy"), Equals, "script-src 'nonce-fixed'")
+	c.Check(w.Body.String(), Equals, `<script nonce="fixed"></script>`)
+}
+
+func BenchmarkNonceSource(b *testing.B) {
+	pool := newNoncePool(randomNonces{length: 32}, 1024)
+	for _, d := range []struct {
+		name   string
+		source nonceSource
+	}{
+		{"random", randomNonces{length: 32}},
+		{"pool", pool},
+	} {
+		b.Run(d.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					d.source.Nonce()
+				}
+			})
+		})
+	}
+}
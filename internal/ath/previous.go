@@ -0,0 +1,246 @@
+package ath
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// retainedRoute serves a versionned file of a previous bundle, until
+// it expires.
+type retainedRoute struct {
+	StaticRoute
+	// expires is zero for files retained forever.
+	expires time.Time
+}
+
+func (r retainedRoute) Flags() RouteFlag {
+	return r.StaticRoute.Flags() | RETAINED
+}
+
+// PreCache does nothing: retained files are only requested by stale
+// clients, and are cached on their first request.
+func (r retainedRoute) PreCache() int64 {
+	return 0
+}
+
+func (r retainedRoute) expired(now time.Time) bool {
+	return r.expires.IsZero() == false && now.After(r.expires)
+}
+
+// isExpired returns true for retained routes past their grace period.
+func isExpired(route Route, now time.Time) bool {
+	retained, ok := route.(retainedRoute)
+	return ok == true && retained.expired(now) == true
+}
+
+// addPreviousBundles adds to routes the versionned files of the
+// previous bundles that the current bundle does not have, so that
+// clients loaded before a deployment can still load their lazy
+// chunks.
+func (b *routeBuilder) addPreviousBundles(routes map[string]Route) error {
+	bundles := b.config.Previous.Bundles
+	if b.config.Previous.Keep >= 0 && len(bundles) > b.config.Previous.Keep {
+		bundles = bundles[:b.config.Previous.Keep]
+	}
+	var expires time.Time
+	if b.config.Previous.GracePeriod > 0 {
+		expires = time.Now().Add(b.config.Previous.GracePeriod)
+	}
+
+	for _, bundle := range bundles {
+		root, err := openBundle(bundle, b.config.Previous.ExtractDir)
+		if err != nil {
+			return err
+		}
+		previous := *b
+		previous.root = root
+		previous.integrity = nil
+
+		count := 0
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() == true || isVersionned(path) == false {
+				return err
+			}
+			target := b.basePath + buildTarget(root, path)
+			if _, ok := routes[target]; ok == true {
+				return nil
+			}
+			route, err := previous.buildStaticRoute(path, d)
+			if err != nil {
+				return err
+			}
+			routes[target] = retainedRoute{StaticRoute: route.(StaticRoute), expires: expires}
+			count += 1
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("previous bundle '%s': %w", bundle, err)
+		}
+		zap.L().Info("retaining files of previous bundle",
+			zap.String("bundle", bundle),
+			zap.Int("files", count),
+			zap.Time("until", expires))
+	}
+	return nil
+}
+
+// openBundle returns the directory of a bundle. Archives are
+// extracted in extractDir, always in the same directory for a given
+// archive path, so that restarts do not accumulate extracted copies.
+func openBundle(path, extractDir string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() == true {
+		return path, nil
+	}
+
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if len(extractDir) == 0 {
+		extractDir = filepath.Join(os.TempDir(), "angular-to-http")
+	}
+	sum := sha256.Sum256([]byte(absolute))
+	dir := filepath.Join(extractDir, fmt.Sprintf("%s-%x", filepath.Base(path), sum[:4]))
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".zip"):
+		err = extractZip(path, dir)
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		err = extractTar(path, dir, true)
+	case strings.HasSuffix(path, ".tar"):
+		err = extractTar(path, dir, false)
+	default:
+		err = fmt.Errorf("unsupported archive '%s', expected .tar, .tar.gz, .tgz or .zip", path)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return archiveRoot(dir)
+}
+
+// archiveRoot descends into the single top-level directory of the
+// extracted archive dir, if any, e.g. for archives of 'dist/app'.
+func archiveRoot(dir string) (string, error) {
+	for {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return "", err
+		}
+		if len(entries) != 1 || entries[0].IsDir() == false {
+			return dir, nil
+		}
+		dir = filepath.Join(dir, entries[0].Name())
+	}
+}
+
+// archiveTarget returns where to extract name in dir, or an error if
+// it escapes dir.
+func archiveTarget(dir, name string) (string, error) {
+	name = filepath.FromSlash(strings.TrimPrefix(name, "./"))
+	if filepath.IsLocal(name) == false {
+		return "", fmt.Errorf("invalid path '%s' in archive", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func extractFile(target string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func extractTar(path, dir string, compressed bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed == true {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("open '%s': %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read '%s': %w", path, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		target, err := archiveTarget(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		if err := extractFile(target, archive); err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(path, dir string) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("open '%s': %w", path, err)
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if file.Mode().IsRegular() == false {
+			continue
+		}
+		target, err := archiveTarget(dir, file.Name)
+		if err != nil {
+			return err
+		}
+		r, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = extractFile(target, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package ath
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type PreviousSuite struct{}
+
+var _ = Suite(&PreviousSuite{})
+
+var previousBundle = map[string]string{
+	"index.html":                 "<html><body>previous</body></html>",
+	"main.0123456789abcdef.js":   "previous main",
+	"123.0000000000abcdef.js":    "previous chunk",
+	"assets/logo.svg":            "<svg></svg>",
+	"fr/456.1111111111abcdef.js": "previous french chunk",
+}
+
+func writeBundle(c *C, files map[string]string) string {
+	dir := c.MkDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(os.WriteFile(path, []byte(content), 0644), IsNil)
+	}
+	return dir
+}
+
+func writeTarGz(c *C, files map[string]string) string {
+	path := filepath.Join(c.MkDir(), "bundle.tar.gz")
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+	archive := tar.NewWriter(gz)
+	defer archive.Close()
+	for name, content := range files {
+		c.Assert(archive.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}), IsNil)
+		_, err := archive.Write([]byte(content))
+		c.Assert(err, IsNil)
+	}
+	return path
+}
+
+func writeZip(c *C, files map[string]string) string {
+	path := filepath.Join(c.MkDir(), "bundle.zip")
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	archive := zip.NewWriter(f)
+	defer archive.Close()
+	for name, content := range files {
+		w, err := archive.Create(name)
+		c.Assert(err, IsNil)
+		_, err = w.Write([]byte(content))
+		c.Assert(err, IsNil)
+	}
+	return path
+}
+
+func (s *PreviousSuite) buildRoutes(c *C, args ...string) map[string]Route {
+	current := writeBundle(c, map[string]string{
+		"index.html":               "<html><body>current</body></html>",
+		"main.0123456789abcdef.js": "current main",
+	})
+	var config Config
+	_, err := flags.ParseArgs(&config, append([]string{current, "--csp.nonce-disable"}, args...))
+	c.Assert(err, IsNil)
+	routes, err := BuildRoutes(config)
+	c.Assert(err, IsNil)
+	return routes
+}
+
+func (s *PreviousSuite) TestBundles(c *C) {
+	// archives of the build directory, e.g. 'tar czf app.tgz dist/'.
+	nested := make(map[string]string)
+	for name, content := range previousBundle {
+		nested["dist/app/"+name] = content
+	}
+	extractDir := c.MkDir()
+	for _, bundle := range []string{
+		writeBundle(c, previousBundle),
+		writeTarGz(c, previousBundle),
+		writeZip(c, previousBundle),
+		writeTarGz(c, nested),
+		writeZip(c, nested),
+	} {
+		comment := Commentf("%s", bundle)
+		routes := s.buildRoutes(c, "--previous.bundle", bundle, "--previous.extract-dir", extractDir)
+		c.Check(routes, HasLen, 4, comment)
+		c.Check(routes["/123.0000000000abcdef.js"], FitsTypeOf, retainedRoute{}, comment)
+		c.Check(routes["/fr/456.1111111111abcdef.js"], FitsTypeOf, retainedRoute{}, comment)
+		// the current bundle wins, and unversionned files are not retained.
+		c.Check(routes["/main.0123456789abcdef.js"], FitsTypeOf, StaticRoute{}, comment)
+		c.Check(routes["/assets/logo.svg"], IsNil, comment)
+
+		route := routes["/123.0000000000abcdef.js"]
+		c.Check(route.Flags()&(IMMUTABLE|RETAINED), Equals, IMMUTABLE|RETAINED, comment)
+		c.Check(route.PreCache(), Equals, int64(0), comment)
+
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, httptest.NewRequest("GET", "/123.0000000000abcdef.js", nil))
+		c.Check(w.Body.String(), Equals, "previous chunk", comment)
+	}
+}
+
+func (s *PreviousSuite) TestExtractDir(c *C) {
+	extractDir := c.MkDir()
+	archive := writeTarGz(c, previousBundle)
+	root, err := openBundle(archive, extractDir)
+	c.Assert(err, IsNil)
+	c.Check(filepath.Dir(root), Equals, extractDir)
+	c.Assert(os.WriteFile(filepath.Join(root, "stale.js"), nil, 0644), IsNil)
+
+	// restarts reuse and clean the same directory.
+	again, err := openBundle(archive, extractDir)
+	c.Assert(err, IsNil)
+	c.Check(again, Equals, root)
+	_, err = os.Stat(filepath.Join(root, "stale.js"))
+	c.Check(os.IsNotExist(err), Equals, true)
+	entries, err := os.ReadDir(extractDir)
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 1)
+
+	other, err := openBundle(writeZip(c, previousBundle), extractDir)
+	c.Assert(err, IsNil)
+	c.Check(other, Not(Equals), root)
+
+	root, err = openBundle(writeZip(c, map[string]string{"app/main.js": "main"}), extractDir)
+	c.Assert(err, IsNil)
+	c.Check(filepath.Base(root), Equals, "app")
+	root, err = openBundle(writeTarGz(c, map[string]string{"main.js": "main"}), extractDir)
+	c.Assert(err, IsNil)
+	c.Check(filepath.Dir(root), Equals, extractDir)
+}
+
+func (s *PreviousSuite) TestKeep(c *C) {
+	older := writeBundle(c, map[string]string{"789.2222222222abcdef.js": "older"})
+	previous := writeBundle(c, previousBundle)
+
+	routes := s.buildRoutes(c, "--previous.bundle", previous, "--previous.bundle", older)
+	c.Check(routes["/789.2222222222abcdef.js"], IsNil)
+
+	routes = s.buildRoutes(c, "--previous.bundle", previous, "--previous.bundle", older,
+		"--previous.keep", "-1")
+	c.Check(routes["/789.2222222222abcdef.js"], NotNil)
+
+	routes = s.buildRoutes(c, "--previous.bundle", previous, "--previous.keep", "0")
+	c.Check(routes, HasLen, 2)
+}
+
+func (s *PreviousSuite) TestGracePeriod(c *C) {
+	routes := s.buildRoutes(c, "--previous.bundle", writeBundle(c, previousBundle),
+		"--previous.grace-period", "1h")
+	route := routes["/123.0000000000abcdef.js"].(retainedRoute)
+	c.Check(route.expired(time.Now()), Equals, false)
+	c.Check(route.expired(time.Now().Add(2*time.Hour)), Equals, true)
+
+	routes = s.buildRoutes(c, "--previous.bundle", writeBundle(c, previousBundle),
+		"--previous.grace-period", "0")
+	route = routes["/123.0000000000abcdef.js"].(retainedRoute)
+	c.Check(route.expired(time.Now().Add(24*365*time.Hour)), Equals, false)
+
+	route.expires = time.Now().Add(-time.Second)
+	routes["/123.0000000000abcdef.js"] = route
+	h := NewHandler(routes, WithFallbackRules(false, nil))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/123.0000000000abcdef.js", nil))
+	c.Check(w.Code, Equals, http.StatusNotFound)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/fr/456.1111111111abcdef.js", nil))
+	c.Check(w.Code, Equals, http.StatusOK)
+}
+
+func (s *PreviousSuite) TestInvalidArchives(c *C) {
+	_, err := openBundle(writeTarGz(c, map[string]string{"../evil.js": "evil"}), c.MkDir())
+	c.Check(err, ErrorMatches, "invalid path '../evil.js' in archive")
+
+	_, err = openBundle(writeZip(c, map[string]string{"/etc/evil.js": "evil"}), c.MkDir())
+	c.Check(err, ErrorMatches, "invalid path '/etc/evil.js' in archive")
+
+	path := filepath.Join(c.MkDir(), "bundle.rar")
+	c.Assert(os.WriteFile(path, nil, 0644), IsNil)
+	_, err = openBundle(path, c.MkDir())
+	c.Check(err, ErrorMatches, "unsupported archive '.*bundle.rar', expected .tar, .tar.gz, .tgz or .zip")
+
+	_, err = openBundle(filepath.Join(c.MkDir(), "missing"), c.MkDir())
+	c.Check(err, NotNil)
+}
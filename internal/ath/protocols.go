@@ -0,0 +1,59 @@
+package ath
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// withH2C lets handler accept HTTP/2 cleartext connections, either
+// with prior knowledge or through an upgrade from HTTP/1.1. The
+// read and write timeouts and the header size limit are the ones of
+// the http.Server serving the connections, see newHTTPServer.
+func withH2C(config Config, handler http.Handler) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{
+		IdleTimeout: config.Server.IdleTimeout,
+	})
+}
+
+// http3Addresses returns the UDP addresses to serve HTTP/3 on, the
+// ones of the TCP listeners, and their port advertised with Alt-Svc.
+func http3Addresses(config Config) ([]string, int, error) {
+	for _, address := range listenAddresses(config) {
+		if isSocketAddress(address) == true {
+			return nil, 0, fmt.Errorf("--protocol.http3 requires TCP listen addresses, got '%s'", address)
+		}
+	}
+	addresses, port, err := tcpListenAddresses(config)
+	if err != nil {
+		return nil, 0, fmt.Errorf("--protocol.http3: %w", err)
+	}
+	return addresses, port, nil
+}
+
+func newHTTP3Server(address string, port int, handler http.Handler, tlsConfig *tls.Config) *http3.Server {
+	return &http3.Server{
+		Addr:      address,
+		Port:      port,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig.Clone()),
+	}
+}
+
+// altSvcHandler advertises the HTTP/3 endpoint of server on each
+// response.
+type altSvcHandler struct {
+	handler http.Handler
+	server  *http3.Server
+}
+
+func (h altSvcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.ProtoMajor < 3 {
+		h.server.SetQuicHeaders(w.Header())
+	}
+	h.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,168 @@
+package ath
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	. "gopkg.in/check.v1"
+)
+
+type ProtocolsSuite struct {
+	handler http.Handler
+	content string
+}
+
+var _ = Suite(&ProtocolsSuite{})
+
+func (s *ProtocolsSuite) SetUpSuite(c *C) {
+	dir := c.MkDir()
+	s.content = "<html><body><h1>Hello World!</h1></body></html>"
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(s.content), 0644), IsNil)
+	s.handler = NewHandler(map[string]Route{
+		"/index.html": StaticRoute{
+			route:    route{"index.html", "text/html; charset=utf-8", []Compression{GZIP}},
+			filepath: filepath.Join(dir, "index.html"),
+			cache:    NewCache(-1),
+		},
+	})
+}
+
+func (s *ProtocolsSuite) checkResponse(c *C, resp *http.Response, protoMajor int) {
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.ProtoMajor, Equals, protoMajor)
+	c.Check(resp.Header.Get("Content-Encoding"), Equals, "gzip")
+	c.Check(resp.ContentLength > 0, Equals, true)
+	reader, err := gzip.NewReader(resp.Body)
+	c.Assert(err, IsNil)
+	content, err := io.ReadAll(reader)
+	c.Assert(err, IsNil)
+	c.Check(string(content), Equals, s.content)
+}
+
+func (s *ProtocolsSuite) TestHTTP3Addresses(c *C) {
+	testdata := []struct {
+		Args      []string
+		Addresses []string
+		Port      int
+		Error     string
+	}{
+		{[]string{"--port", "8443"}, []string{"0.0.0.0:8443"}, 8443, ""},
+		{[]string{"--listen", "127.0.0.1:443", "--listen", "[::1]:443"},
+			[]string{"127.0.0.1:443", "[::1]:443"}, 443, ""},
+		{[]string{"--listen", "127.0.0.1:443", "--listen", "[::1]:8443"}, nil, 0,
+			"--protocol.http3: listen addresses do not share a port, got 443 and 8443"},
+		{[]string{"--listen", "unix:/run/ath.sock"}, nil, 0,
+			"--protocol.http3 requires TCP listen addresses, got 'unix:/run/ath.sock'"},
+		{[]string{"--listen", "systemd"}, nil, 0,
+			"--protocol.http3 requires TCP listen addresses, got 'systemd'"},
+	}
+	for _, d := range testdata {
+		var config Config
+		_, err := flags.ParseArgs(&config, d.Args)
+		c.Assert(err, IsNil)
+		addresses, port, err := http3Addresses(config)
+		if len(d.Error) > 0 {
+			c.Check(err, ErrorMatches, d.Error, Commentf("%v", d.Args))
+			continue
+		}
+		c.Check(err, IsNil, Commentf("%v", d.Args))
+		c.Check(addresses, DeepEquals, d.Addresses, Commentf("%v", d.Args))
+		c.Check(port, Equals, d.Port, Commentf("%v", d.Args))
+	}
+}
+
+func (s *ProtocolsSuite) TestH2C(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"--server.idle-timeout", "100ms", "--server.max-header-bytes", "1k"})
+	c.Assert(err, IsNil)
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = newHTTPServer(config, withH2C(config, s.handler))
+	server.Start()
+	defer server.Close()
+
+	dials := 0
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				dials++
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	req, err := http.NewRequest("GET", server.URL+"/index.html", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	s.checkResponse(c, resp, 2)
+
+	// the server limits apply to HTTP/2 connections.
+	req, err = http.NewRequest("GET", server.URL+"/index.html", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("X-Large", strings.Repeat("a", 2048))
+	_, err = client.Do(req)
+	c.Check(err, ErrorMatches, ".*request header list larger than peer's advertised limit")
+	time.Sleep(300 * time.Millisecond)
+	resp, err = client.Get(server.URL + "/index.html")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(dials, Equals, 2)
+
+	// HTTP/1.1 clients are still served
+	resp, err = http.Get(server.URL + "/index.html")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Check(resp.ProtoMajor, Equals, 1)
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ProtocolsSuite) TestHTTP3(c *C) {
+	dir := c.MkDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(c, certFile, keyFile, "localhost")
+	store, err := newCertificateStore(certFile, keyFile, "")
+	c.Assert(err, IsNil)
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+
+	server := newHTTP3Server(udp.LocalAddr().String(), port, s.handler, newTLSConfig(store.GetCertificate))
+	go server.Serve(udp)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http3.RoundTripper{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	req, err := http.NewRequest("GET", "https://"+udp.LocalAddr().String()+"/index.html", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	s.checkResponse(c, resp, 3)
+
+	// the server is now listening and can advertise itself.
+	w := httptest.NewRecorder()
+	altSvcHandler{handler: s.handler, server: server}.ServeHTTP(w,
+		httptest.NewRequest("GET", "/index.html", nil))
+	c.Check(w.Header().Get("Alt-Svc"), Equals, fmt.Sprintf(`h3=":%d"; ma=2592000`, port))
+}
@@ -0,0 +1,245 @@
+package ath
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type trustedProxies []*net.IPNet
+
+func parseTrustedProxies(cidrs []string) (trustedProxies, error) {
+	res := make(trustedProxies, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if strings.Contains(cidr, "/") == false {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w", cidr, err)
+		}
+		res = append(res, network)
+	}
+	return res, nil
+}
+
+func (t trustedProxies) contains(address string) bool {
+	ip := net.ParseIP(hostOnly(address))
+	if ip == nil {
+		return false
+	}
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOnly strips the port and IPv6 brackets of address, if any.
+func hostOnly(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+}
+
+type forwardedHop struct {
+	client, proto, host string
+}
+
+func unquote(value string) string {
+	return strings.Trim(strings.TrimSpace(value), `"`)
+}
+
+// parseForwarded parses a RFC 7239 Forwarded header.
+func parseForwarded(values []string) []forwardedHop {
+	var res []forwardedHop
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := forwardedHop{}
+			for _, pair := range strings.Split(element, ";") {
+				key, value, _ := strings.Cut(pair, "=")
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "for":
+					hop.client = hostOnly(unquote(value))
+				case "proto":
+					hop.proto = strings.ToLower(unquote(value))
+				case "host":
+					hop.host = unquote(value)
+				}
+			}
+			res = append(res, hop)
+		}
+	}
+	return res
+}
+
+// lastValue returns the right-most value of a comma separated list
+// header, i.e. the one added by the nearest proxy.
+func lastValue(header http.Header, name string) string {
+	values := header.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	items := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(items[len(items)-1])
+}
+
+func parseXForwarded(header http.Header, host bool) []forwardedHop {
+	var res []forwardedHop
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, client := range strings.Split(value, ",") {
+			res = append(res, forwardedHop{client: hostOnly(strings.TrimSpace(client))})
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	// X-Forwarded-Proto and -Host are not per hop: the nearest proxy
+	// value is used for the resolved hop.
+	for i := range res {
+		res[i].proto = strings.ToLower(lastValue(header, "X-Forwarded-Proto"))
+		if host == true {
+			res[i].host = lastValue(header, "X-Forwarded-Host")
+		}
+	}
+	return res
+}
+
+const (
+	headerForwarded     = "forwarded"
+	headerXForwardedFor = "x-forwarded-for"
+)
+
+// forwardedResolver resolves the client of requests from trusted
+// proxies, using only the header these proxies are configured to
+// set: any other header may come unchanged from the client.
+type forwardedResolver struct {
+	trusted trustedProxies
+	// header is headerForwarded or headerXForwardedFor.
+	header string
+	// host trusts X-Forwarded-Host along X-Forwarded-For.
+	host bool
+}
+
+func newForwardedResolver(config Config) (*forwardedResolver, error) {
+	trusted, err := parseTrustedProxies(config.Proxy.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	if len(trusted) == 0 {
+		return nil, nil
+	}
+	header := strings.ToLower(config.Proxy.Header)
+	if header != headerForwarded && header != headerXForwardedFor {
+		return nil, fmt.Errorf("invalid --proxy.header '%s', expected '%s' or '%s'",
+			config.Proxy.Header, headerXForwardedFor, headerForwarded)
+	}
+	if config.Proxy.ForwardedHost == true && header != headerXForwardedFor {
+		return nil, fmt.Errorf("--proxy.forwarded-host requires --proxy.header=%s", headerXForwardedFor)
+	}
+	return &forwardedResolver{
+		trusted: trusted,
+		header:  header,
+		host:    config.Proxy.ForwardedHost,
+	}, nil
+}
+
+// resolve returns the right-most hop that is not a trusted proxy, or
+// false if the request does not come from a trusted proxy or only
+// lists trusted proxies.
+func (r *forwardedResolver) resolve(req *http.Request) (forwardedHop, bool) {
+	if r.trusted.contains(req.RemoteAddr) == false {
+		return forwardedHop{}, false
+	}
+
+	var hops []forwardedHop
+	if r.header == headerForwarded {
+		hops = parseForwarded(req.Header.Values("Forwarded"))
+	} else {
+		hops = parseXForwarded(req.Header, r.host)
+	}
+
+	// values left of the first untrusted hop are client supplied.
+	for i := len(hops) - 1; i >= 0; i-- {
+		if r.trusted.contains(hops[i].client) == false {
+			return hops[i], true
+		}
+	}
+	return forwardedHop{}, false
+}
+
+type forwardedHandler struct {
+	handler  http.Handler
+	resolver *forwardedResolver
+}
+
+// withForwarded makes requests coming from trusted proxies use the
+// client address, scheme and host they forwarded.
+func withForwarded(handler http.Handler, resolver *forwardedResolver) http.Handler {
+	return forwardedHandler{handler: handler, resolver: resolver}
+}
+
+func (h forwardedHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	hop, ok := h.resolver.resolve(req)
+	if ok == false {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), proxyAddressKey{}, req.RemoteAddr)
+	req = req.Clone(ctx)
+	if net.ParseIP(hop.client) != nil {
+		req.RemoteAddr = hop.client
+	}
+	if hop.proto == "http" || hop.proto == "https" {
+		req.URL.Scheme = hop.proto
+	}
+	if len(hop.host) > 0 {
+		req.Host = hop.host
+	}
+	h.handler.ServeHTTP(w, req)
+}
+
+type proxyAddressKey struct{}
+
+// proxyAddress returns the address of the trusted proxy that
+// forwarded req, if any.
+func proxyAddress(req *http.Request) string {
+	address, _ := req.Context().Value(proxyAddressKey{}).(string)
+	return address
+}
+
+func traceForwarded(req *http.Request) {
+	trace.SpanFromContext(req.Context()).SetAttributes(
+		attribute.String("http.client_ip", hostOnly(req.RemoteAddr)),
+		attribute.String("http.scheme", requestScheme(req)),
+	)
+}
+
+// requestScheme returns the scheme used by the client, as resolved
+// from trusted proxies or from the connection.
+func requestScheme(req *http.Request) string {
+	if len(req.URL.Scheme) > 0 {
+		return req.URL.Scheme
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,184 @@
+package ath
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const proxyProtocolTimeout = 5 * time.Second
+
+var errMissingProxyHeader = errors.New("missing PROXY protocol header")
+
+type proxyProtocolListener struct {
+	net.Listener
+	trusted  trustedProxies
+	optional bool
+}
+
+// withProxyProtocol reads PROXY protocol v1 or v2 headers on
+// connections from trusted proxies, to report the original client
+// address. Connections on unix sockets are always trusted, as access
+// is restricted by the socket permissions. Trusted connections
+// without a header are rejected, unless optional is set.
+func withProxyProtocol(l net.Listener, trusted trustedProxies, optional bool) net.Listener {
+	return &proxyProtocolListener{Listener: l, trusted: trusted, optional: optional}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{
+		Conn:     conn,
+		reader:   bufio.NewReader(conn),
+		trusted:  l.Addr().Network() == "unix" || l.trusted.contains(conn.RemoteAddr().String()),
+		optional: l.optional,
+	}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader            *bufio.Reader
+	trusted, optional bool
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// init reads the header on first use, so a slow client does not
+// block the accept loop.
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		if c.trusted == false {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		c.remote, c.err = readProxyHeader(c.reader)
+		if c.optional == true && errors.Is(c.err, errMissingProxyHeader) == true {
+			c.err = nil
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader returns the source address of a PROXY protocol
+// header, or nil if it does not carry an address. It returns
+// errMissingProxyHeader if there is no header.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	signature, err := r.Peek(len(proxyProtocolV2Signature))
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return nil, errMissingProxyHeader
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// at most 107 bytes per specification.
+	line := make([]byte, 0, 107)
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if bytes.HasSuffix(line, []byte("\r\n")) == false {
+		return nil, errors.New("PROXY v1 header: line too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("PROXY v1 header: invalid header '%s'", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("PROXY v1 header: invalid source '%s:%s'", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("PROXY v2 header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("PROXY v2 header: unsupported version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("PROXY v2 header: %w", err)
+	}
+
+	// LOCAL command, e.g. health checks from the proxy itself.
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, fmt.Errorf("PROXY v2 header: unsupported command %d", command)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("PROXY v2 header: truncated IPv4 addresses")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("PROXY v2 header: truncated IPv6 addresses")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	return nil, nil
+}
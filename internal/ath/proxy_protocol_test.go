@@ -0,0 +1,112 @@
+package ath
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProxyProtocolSuite struct{}
+
+var _ = Suite(&ProxyProtocolSuite{})
+
+func proxyHeaderV2(command byte, family byte, addresses []byte) string {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return string(append(header, addresses...))
+}
+
+func (s *ProxyProtocolSuite) TestReadHeader(c *C) {
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0x12, 0x34, 0, 80}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(ipv6[32:], 4711)
+
+	testdata := []struct {
+		Input, Address, Error string
+	}{
+		{"GET / HTTP/1.1\r\n", "", "missing PROXY protocol header"},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 4660 80\r\nGET / HTTP/1.1\r\n", "192.0.2.1:4660", ""},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4711 443\r\nGET / HTTP/1.1\r\n", "[2001:db8::1]:4711", ""},
+		{"PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n", "", ""},
+		{"PROXY TCP4 foo 192.0.2.2 4660 80\r\n", "", "PROXY v1 header: invalid source 'foo:4660'"},
+		{"PROXY TCP4 192.0.2.1" + strings.Repeat(" ", 100) + "\r\n", "", "PROXY v1 header: line too long"},
+		{proxyHeaderV2(1, 0x11, ipv4) + "GET / HTTP/1.1\r\n", "192.0.2.1:4660", ""},
+		{proxyHeaderV2(1, 0x21, ipv6) + "GET / HTTP/1.1\r\n", "[2001:db8::1]:4711", ""},
+		{proxyHeaderV2(0, 0x00, nil) + "GET / HTTP/1.1\r\n", "", ""},
+		{proxyHeaderV2(1, 0x11, ipv4[:4]), "", "PROXY v2 header: truncated IPv4 addresses"},
+	}
+
+	for _, d := range testdata {
+		comment := Commentf("input: %q", d.Input)
+		r := bufio.NewReader(strings.NewReader(d.Input))
+		address, err := readProxyHeader(r)
+		if len(d.Error) > 0 {
+			c.Check(err, ErrorMatches, d.Error, comment)
+			continue
+		}
+		if c.Check(err, IsNil, comment) == false {
+			continue
+		}
+		if len(d.Address) == 0 {
+			c.Check(address, IsNil, comment)
+		} else if c.Check(address, NotNil, comment) == true {
+			c.Check(address.String(), Equals, d.Address, comment)
+		}
+		rest, _ := io.ReadAll(r)
+		c.Check(string(rest), Equals, "GET / HTTP/1.1\r\n", comment)
+	}
+}
+
+func (s *ProxyProtocolSuite) TestListener(c *C) {
+	header := "PROXY TCP4 192.0.2.1 192.0.2.2 4660 80\r\n"
+	for _, d := range []struct {
+		Trusted  []string
+		Optional bool
+		Sent     string
+		Address  string
+		Received string
+		Error    string
+	}{
+		{[]string{"127.0.0.1"}, false, header + "hello", "192.0.2.1:4660", "hello", ""},
+		{[]string{"127.0.0.1"}, true, header + "hello", "192.0.2.1:4660", "hello", ""},
+		{[]string{"127.0.0.1"}, false, "hello", "127.0.0.1", "", "missing PROXY protocol header"},
+		{[]string{"127.0.0.1"}, true, "hello", "127.0.0.1", "hello", ""},
+		// untrusted sources are passed through unmodified.
+		{[]string{"10.0.0.0/8"}, false, header + "hello", "127.0.0.1", header + "hello", ""},
+	} {
+		comment := Commentf("%+v", d)
+		trusted, err := parseTrustedProxies(d.Trusted)
+		c.Assert(err, IsNil)
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, IsNil)
+		l := withProxyProtocol(inner, trusted, d.Optional)
+
+		go func() {
+			conn, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte(d.Sent))
+		}()
+
+		conn, err := l.Accept()
+		c.Assert(err, IsNil)
+		c.Check(conn.RemoteAddr().String(), Matches, d.Address+".*", comment)
+		data, err := io.ReadAll(conn)
+		if len(d.Error) > 0 {
+			c.Check(err, ErrorMatches, d.Error, comment)
+		} else {
+			c.Check(err, IsNil, comment)
+		}
+		c.Check(string(data), Equals, d.Received, comment)
+		conn.Close()
+		l.Close()
+	}
+}
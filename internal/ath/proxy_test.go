@@ -0,0 +1,219 @@
+package ath
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProxySuite struct{}
+
+var _ = Suite(&ProxySuite{})
+
+func (s *ProxySuite) TestParseTrustedProxies(c *C) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	c.Assert(err, IsNil)
+	c.Check(trusted.contains("10.1.2.3:4567"), Equals, true)
+	c.Check(trusted.contains("192.168.1.1"), Equals, true)
+	c.Check(trusted.contains("192.168.1.2"), Equals, false)
+	c.Check(trusted.contains("[::1]:80"), Equals, true)
+	c.Check(trusted.contains("not-an-ip"), Equals, false)
+
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	c.Check(err, ErrorMatches, "invalid trusted proxy '10.0.0.0/33': .*")
+	_, err = parseTrustedProxies([]string{"proxy.local"})
+	c.Check(err, ErrorMatches, "invalid trusted proxy 'proxy.local'")
+}
+
+func testResolver(c *C, header string, trusted ...string) *forwardedResolver {
+	var config Config
+	config.Proxy.Trusted = trusted
+	config.Proxy.Header = header
+	res, err := newForwardedResolver(config)
+	c.Assert(err, IsNil)
+	return res
+}
+
+func (s *ProxySuite) TestNewResolver(c *C) {
+	var config Config
+	config.Proxy.Header = headerForwarded
+	res, err := newForwardedResolver(config)
+	c.Check(err, IsNil)
+	c.Check(res, IsNil)
+
+	config.Proxy.Trusted = []string{"10.0.0.1"}
+	config.Proxy.Header = "X-Real-IP"
+	_, err = newForwardedResolver(config)
+	c.Check(err, ErrorMatches, "invalid --proxy.header 'X-Real-IP', expected 'x-forwarded-for' or 'forwarded'")
+
+	config.Proxy.Header = headerForwarded
+	config.Proxy.ForwardedHost = true
+	_, err = newForwardedResolver(config)
+	c.Check(err, ErrorMatches, "--proxy.forwarded-host requires --proxy.header=x-forwarded-for")
+}
+
+func (s *ProxySuite) TestResolve(c *C) {
+	testdata := []struct {
+		Header  string
+		Host    bool
+		Remote  string
+		Headers map[string]string
+		Hop     forwardedHop
+		Ok      bool
+	}{
+		{
+			Header:  headerXForwardedFor,
+			Remote:  "1.2.3.4:1234",
+			Headers: map[string]string{"X-Forwarded-For": "5.6.7.8"},
+		},
+		{
+			Header: headerXForwardedFor,
+			Remote: "10.0.0.1:1234",
+		},
+		{
+			Header:  headerXForwardedFor,
+			Remote:  "10.0.0.1:1234",
+			Headers: map[string]string{"X-Forwarded-For": "5.6.7.8", "X-Forwarded-Proto": "https"},
+			Hop:     forwardedHop{client: "5.6.7.8", proto: "https"},
+			Ok:      true,
+		},
+		{
+			// spoofed first hop is ignored, the last untrusted is used.
+			Header:  headerXForwardedFor,
+			Remote:  "10.0.0.1:1234",
+			Headers: map[string]string{"X-Forwarded-For": "6.6.6.6, 5.6.7.8, 10.0.0.2"},
+			Hop:     forwardedHop{client: "5.6.7.8"},
+			Ok:      true,
+		},
+		{
+			// a client Forwarded header passed through is ignored.
+			Header: headerXForwardedFor,
+			Remote: "10.0.0.1:1234",
+			Headers: map[string]string{
+				"Forwarded":       "for=6.6.6.6;host=evil.com",
+				"X-Forwarded-For": "5.6.7.8",
+			},
+			Hop: forwardedHop{client: "5.6.7.8"},
+			Ok:  true,
+		},
+		{
+			// X-Forwarded-Host is only trusted if configured.
+			Header: headerXForwardedFor,
+			Remote: "10.0.0.1:1234",
+			Headers: map[string]string{
+				"X-Forwarded-For":   "5.6.7.8",
+				"X-Forwarded-Host":  "evil.com",
+				"X-Forwarded-Proto": "http, https",
+			},
+			Hop: forwardedHop{client: "5.6.7.8", proto: "https"},
+			Ok:  true,
+		},
+		{
+			Header: headerXForwardedFor,
+			Host:   true,
+			Remote: "10.0.0.1:1234",
+			Headers: map[string]string{
+				"X-Forwarded-For":  "5.6.7.8",
+				"X-Forwarded-Host": "evil.com, example.com",
+			},
+			Hop: forwardedHop{client: "5.6.7.8", host: "example.com"},
+			Ok:  true,
+		},
+		{
+			// only trusted proxies: the left-most value is never used.
+			Header:  headerXForwardedFor,
+			Remote:  "10.0.0.1:1234",
+			Headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+		},
+		{
+			Header: headerForwarded,
+			Remote: "10.0.0.1:1234",
+			Headers: map[string]string{
+				"Forwarded":       `for="[2001:db8::1]:4711";proto=https;host=example.com, for=10.0.0.2`,
+				"X-Forwarded-For": "6.6.6.6",
+			},
+			Hop: forwardedHop{client: "2001:db8::1", proto: "https", host: "example.com"},
+			Ok:  true,
+		},
+		{
+			Header: headerForwarded,
+			Remote: "10.0.0.1:1234",
+			Headers: map[string]string{
+				"Forwarded": "for=6.6.6.6;host=evil.com, for=5.6.7.8;host=example.com",
+			},
+			Hop: forwardedHop{client: "5.6.7.8", host: "example.com"},
+			Ok:  true,
+		},
+		{
+			// the one header is not set by the proxy.
+			Header:  headerForwarded,
+			Remote:  "10.0.0.1:1234",
+			Headers: map[string]string{"X-Forwarded-For": "5.6.7.8"},
+		},
+	}
+
+	for _, d := range testdata {
+		resolver := testResolver(c, d.Header, "10.0.0.0/8")
+		resolver.host = d.Host
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = d.Remote
+		for name, value := range d.Headers {
+			req.Header.Set(name, value)
+		}
+		hop, ok := resolver.resolve(req)
+		c.Check(ok, Equals, d.Ok, Commentf("%s headers: %v", d.Header, d.Headers))
+		c.Check(hop, Equals, d.Hop, Commentf("%s headers: %v", d.Header, d.Headers))
+	}
+}
+
+func (s *ProxySuite) TestForwardedHandler(c *C) {
+	trusted := testResolver(c, headerForwarded, "10.0.0.0/8")
+
+	var served *http.Request
+	handler := withForwarded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		served = req
+	}), trusted)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Forwarded", "for=5.6.7.8;proto=https;host=example.com")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(served, NotNil)
+	c.Check(served.RemoteAddr, Equals, "5.6.7.8")
+	c.Check(requestScheme(served), Equals, "https")
+	c.Check(served.Host, Equals, "example.com")
+	c.Check(proxyAddress(served), Equals, "10.0.0.1:1234")
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("Forwarded", "for=5.6.7.8;proto=https")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	c.Check(served.RemoteAddr, Equals, "1.2.3.4:1234")
+	c.Check(requestScheme(served), Equals, "http")
+	c.Check(proxyAddress(served), Equals, "")
+}
+
+func (s *ProxySuite) TestRedirectSkipsForwardedHTTPS(c *C) {
+	trusted := testResolver(c, headerXForwardedFor, "10.0.0.1")
+	trusted.host = true
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := withForwarded(httpsRedirectHandler{port: 443, next: next}, trusted)
+
+	req := httptest.NewRequest("GET", "http://internal/app", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusTeapot)
+
+	req.Header.Set("X-Forwarded-Proto", "http")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusPermanentRedirect)
+	c.Check(w.Header().Get("Location"), Equals, "https://example.com/app")
+}
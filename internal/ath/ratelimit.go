@@ -0,0 +1,208 @@
+package ath
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket refilled at Rate tokens per second,
+// holding at most Burst tokens. A zero Rate disables limiting.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+var rateLimitRx = regexp.MustCompile(`\A([[:digit:]]+(?:\.[[:digit:]]+)?)/([[:alnum:].]+)(?::([[:digit:]]+))?\z`)
+
+var ratePeriods = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+func (l RateLimit) String() string {
+	if l.Rate == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/s:%d", strconv.FormatFloat(l.Rate, 'f', -1, 64), l.Burst)
+}
+
+func (l RateLimit) MarshalFlag() (string, error) {
+	return l.String(), nil
+}
+
+// UnmarshalFlag parses '<requests>/<period>[:<burst>]', where period
+// is 's', 'm', 'h' or a duration such as '10s'. The burst defaults
+// to the number of requests.
+func (l *RateLimit) UnmarshalFlag(value string) error {
+	m := rateLimitRx.FindStringSubmatch(value)
+	if m == nil {
+		return fmt.Errorf("invalid rate limit '%s', expected '<requests>/<period>[:<burst>]'", value)
+	}
+	requests, err := strconv.ParseFloat(m[1], 64)
+	if err != nil || requests <= 0 {
+		return fmt.Errorf("invalid number of requests '%s' in '%s'", m[1], value)
+	}
+	period, ok := ratePeriods[m[2]]
+	if ok == false {
+		period, err = time.ParseDuration(m[2])
+		if err != nil || period <= 0 {
+			return fmt.Errorf("invalid period '%s' in '%s'", m[2], value)
+		}
+	}
+	burst := int(math.Max(1, math.Ceil(requests)))
+	if len(m[3]) > 0 {
+		burst, err = strconv.Atoi(m[3])
+		if err != nil || burst < 1 {
+			return fmt.Errorf("invalid burst '%s' in '%s'", m[3], value)
+		}
+	}
+	*l = RateLimit{Rate: requests / period.Seconds(), Burst: burst}
+	return nil
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client. At most maxClients
+// buckets are kept, the least recently seen clients being forgotten
+// first.
+type rateLimiter struct {
+	limit      RateLimit
+	maxClients int
+	now        func() time.Time
+
+	mx      sync.Mutex
+	clients map[string]*list.Element
+	list    *list.List
+}
+
+func newRateLimiter(limit RateLimit, maxClients int) *rateLimiter {
+	return &rateLimiter{
+		limit:      limit,
+		maxClients: maxClients,
+		now:        time.Now,
+		clients:    make(map[string]*list.Element),
+		list:       list.New(),
+	}
+}
+
+// clientKey returns the IP of the client of req. IPv6 clients are
+// grouped by /64 prefix, as they usually own a whole one.
+func clientKey(req *http.Request) string {
+	host := hostOnly(req.RemoteAddr)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// allow takes a token for key, or returns the time to wait until one
+// is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := l.now()
+	element, ok := l.clients[key]
+	if ok == false {
+		element = l.list.PushFront(&tokenBucket{
+			key:    key,
+			tokens: float64(l.limit.Burst),
+			last:   now,
+		})
+		l.clients[key] = element
+		l.evictLeastRecent()
+	} else {
+		l.list.MoveToFront(element)
+	}
+
+	bucket := element.Value.(*tokenBucket)
+	bucket.tokens = math.Min(float64(l.limit.Burst),
+		bucket.tokens+now.Sub(bucket.last).Seconds()*l.limit.Rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens -= 1
+		return true, 0
+	}
+	wait := (1 - bucket.tokens) / l.limit.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+func (l *rateLimiter) evictLeastRecent() {
+	for l.maxClients > 0 && l.list.Len() > l.maxClients {
+		back := l.list.Back()
+		l.list.Remove(back)
+		delete(l.clients, back.Value.(*tokenBucket).key)
+	}
+}
+
+// routeClass returns the rate limiting class of r: 'nonced',
+// 'immutable' or 'static'.
+func routeClass(r Route) string {
+	flags := r.Flags()
+	switch {
+	case flags&NONCED != 0:
+		return "nonced"
+	case flags&IMMUTABLE != 0:
+		return "immutable"
+	default:
+		return "static"
+	}
+}
+
+// validateRateLimits checks that enabled rate limits track a bounded
+// number of clients, otherwise their memory would grow with each new
+// client address.
+func validateRateLimits(config Config) error {
+	limits := config.RateLimit
+	enabled := limits.Nonced.Rate > 0 || limits.Static.Rate > 0 || limits.Immutable.Rate > 0
+	if enabled == true && limits.MaxClients <= 0 {
+		return fmt.Errorf("invalid --rate-limit.max-clients %d, expected a positive number", limits.MaxClients)
+	}
+	return nil
+}
+
+// WithRateLimits limits requests per client for each route class
+// present in limits.
+func WithRateLimits(limits map[string]RateLimit, maxClients int) HandlerOption {
+	return func(h *Handler) {
+		h.rateLimiters = make(map[string]*rateLimiter)
+		for class, limit := range limits {
+			if limit.Rate > 0 {
+				h.rateLimiters[class] = newRateLimiter(limit, maxClients)
+			}
+		}
+	}
+}
+
+// rateLimited writes a 429 response if the client of req exceeded
+// the limit of the class of r.
+func (h *Handler) rateLimited(w http.ResponseWriter, req *http.Request, r Route) bool {
+	limiter, ok := h.rateLimiters[routeClass(r)]
+	if ok == false {
+		return false
+	}
+	allowed, wait := limiter.allow(clientKey(req))
+	if allowed == true {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+	return true
+}
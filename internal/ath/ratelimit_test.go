@@ -0,0 +1,194 @@
+package ath
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type RateLimitSuite struct{}
+
+var _ = Suite(&RateLimitSuite{})
+
+func (s *RateLimitSuite) TestParse(c *C) {
+	testdata := []struct {
+		Value string
+		Limit RateLimit
+		Error string
+	}{
+		{"10/s", RateLimit{Rate: 10, Burst: 10}, ""},
+		{"10/s:20", RateLimit{Rate: 10, Burst: 20}, ""},
+		{"60/m", RateLimit{Rate: 1, Burst: 60}, ""},
+		{"1/10s:5", RateLimit{Rate: 0.1, Burst: 5}, ""},
+		{"0.5/s", RateLimit{Rate: 0.5, Burst: 1}, ""},
+		{"10", RateLimit{}, "invalid rate limit '10', expected '<requests>/<period>\\[:<burst>\\]'"},
+		{"0/s", RateLimit{}, "invalid number of requests '0' in '0/s'"},
+		{"10/d", RateLimit{}, "invalid period 'd' in '10/d'"},
+		{"10/s:0", RateLimit{}, "invalid burst '0' in '10/s:0'"},
+	}
+
+	for _, d := range testdata {
+		var limit RateLimit
+		err := limit.UnmarshalFlag(d.Value)
+		if len(d.Error) > 0 {
+			c.Check(err, ErrorMatches, d.Error)
+			continue
+		}
+		c.Check(err, IsNil)
+		c.Check(limit, Equals, d.Limit, Commentf("value: %s", d.Value))
+	}
+
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"--rate-limit.nonced", "5/s:10"})
+	c.Assert(err, IsNil)
+	c.Check(config.RateLimit.Nonced, Equals, RateLimit{Rate: 5, Burst: 10})
+	c.Check(config.RateLimit.Static, Equals, RateLimit{})
+	c.Check(config.RateLimit.MaxClients, Equals, 10000)
+}
+
+func (s *RateLimitSuite) TestValidate(c *C) {
+	testdata := []struct {
+		Args  []string
+		Error string
+	}{
+		{[]string{}, ""},
+		{[]string{"--rate-limit.max-clients", "0"}, ""},
+		{[]string{"--rate-limit.static", "10/s"}, ""},
+		{[]string{"--rate-limit.static", "10/s", "--rate-limit.max-clients", "0"},
+			"invalid --rate-limit.max-clients 0, expected a positive number"},
+		{[]string{"--rate-limit.nonced", "1/s", "--rate-limit.max-clients", "-1"},
+			"invalid --rate-limit.max-clients -1, expected a positive number"},
+	}
+	for _, d := range testdata {
+		var config Config
+		_, err := flags.ParseArgs(&config, d.Args)
+		c.Assert(err, IsNil)
+		if len(d.Error) == 0 {
+			c.Check(validateRateLimits(config), IsNil, Commentf("%v", d.Args))
+		} else {
+			c.Check(validateRateLimits(config), ErrorMatches, d.Error, Commentf("%v", d.Args))
+		}
+	}
+}
+
+func (s *RateLimitSuite) TestTokenBucket(c *C) {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(RateLimit{Rate: 2, Burst: 3}, 10)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.allow("a")
+		c.Check(ok, Equals, true)
+	}
+	ok, wait := limiter.allow("a")
+	c.Check(ok, Equals, false)
+	c.Check(wait, Equals, 500*time.Millisecond)
+
+	// other clients have their own bucket.
+	ok, _ = limiter.allow("b")
+	c.Check(ok, Equals, true)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = limiter.allow("a")
+	c.Check(ok, Equals, true)
+	ok, _ = limiter.allow("a")
+	c.Check(ok, Equals, false)
+
+	// buckets never hold more than burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.allow("a")
+		c.Check(ok, Equals, true)
+	}
+	ok, _ = limiter.allow("a")
+	c.Check(ok, Equals, false)
+}
+
+func (s *RateLimitSuite) TestBoundedClients(c *C) {
+	limiter := newRateLimiter(RateLimit{Rate: 1, Burst: 1}, 100)
+	for i := 0; i < 1000; i++ {
+		limiter.allow(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	c.Check(limiter.list.Len(), Equals, 100)
+	c.Check(limiter.clients, HasLen, 100)
+
+	// most recent clients are kept.
+	ok, _ := limiter.allow("10.0.3.231")
+	c.Check(ok, Equals, false)
+	ok, _ = limiter.allow("10.0.0.0")
+	c.Check(ok, Equals, true)
+}
+
+func (s *RateLimitSuite) TestClientKey(c *C) {
+	testdata := []struct {
+		Address, Key string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"[2001:db8:1:2:3:4:5:6]:1234", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::7", "2001:db8:1:2::/64"},
+		{"@", "@"},
+	}
+	for _, d := range testdata {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = d.Address
+		c.Check(clientKey(req), Equals, d.Key)
+	}
+}
+
+type flaggedRoute RouteFlag
+
+func (r flaggedRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r flaggedRoute) PreCache() int64 {
+	return 0
+}
+
+func (r flaggedRoute) Flags() RouteFlag {
+	return RouteFlag(r)
+}
+
+func (s *RateLimitSuite) TestHandler(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "main.js"), []byte("main"), 0644), IsNil)
+	routes := map[string]Route{
+		"/index.html": flaggedRoute(NONCED),
+		"/main.js": StaticRoute{
+			route:        route{"main.js", "text/javascript", nil},
+			filepath:     filepath.Join(dir, "main.js"),
+			cacheControl: "max-age=31536000; immutable",
+			cache:        NewCache(-1),
+		},
+	}
+	h := NewHandler(routes, WithRateLimits(map[string]RateLimit{
+		"nonced": {Rate: 0.1, Burst: 1},
+		"static": {Rate: 1, Burst: 1},
+	}, 10))
+
+	serve := func(target, address string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = address
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	c.Check(serve("/", "192.0.2.1:1234").Code, Equals, http.StatusNoContent)
+	w := serve("/", "192.0.2.1:4321")
+	c.Check(w.Code, Equals, http.StatusTooManyRequests)
+	c.Check(w.Header().Get("Retry-After"), Equals, "10")
+	c.Check(serve("/index.html", "192.0.2.2:1234").Code, Equals, http.StatusNoContent)
+
+	// immutable files are not limited.
+	for i := 0; i < 5; i++ {
+		c.Check(serve("/main.js", "192.0.2.1:1234").Code, Equals, http.StatusOK)
+	}
+}
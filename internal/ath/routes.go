@@ -2,9 +2,8 @@ package ath
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strings"
@@ -20,10 +19,11 @@ const (
 	NONCED RouteFlag = 1 << iota
 	IMMUTABLE
 	COMPRESSIBLE
+	RETAINED
 )
 
 func (f RouteFlag) String() string {
-	str := make([]string, 0, 3)
+	str := make([]string, 0, 4)
 	if (f & COMPRESSIBLE) != 0 {
 		str = append(str, "COMPRESSIBLE")
 	}
@@ -33,6 +33,9 @@ func (f RouteFlag) String() string {
 	if (f & NONCED) != 0 {
 		str = append(str, "NONCED")
 	}
+	if (f & RETAINED) != 0 {
+		str = append(str, "RETAINED")
+	}
 	return strings.Join(str, ", ")
 }
 
@@ -59,6 +62,8 @@ type StaticRoute struct {
 	route
 
 	filepath string
+	// content, if not nil, is served instead of the file content.
+	content []byte
 
 	modtime time.Time
 
@@ -124,9 +129,16 @@ func (r route) findCompression(req *http.Request) Compression {
 	return Identity
 }
 
+func (r StaticRoute) open() (io.ReadCloser, error) {
+	if r.content != nil {
+		return io.NopCloser(bytes.NewReader(r.content)), nil
+	}
+	return os.Open(r.filepath)
+}
+
 func (r StaticRoute) readFile(compression Compression) func() ([]byte, error) {
 	return func() ([]byte, error) {
-		file, err := os.Open(r.filepath)
+		file, err := r.open()
 		if err != nil {
 			return nil, err
 		}
@@ -143,10 +155,25 @@ type NoncedRoute struct {
 	route
 
 	template *template.Template
+	headers  []string
+	// page, if set, replaces template execution and compression of
+	// each request by splicing the nonce.
+	page *splicedPage
+	// nonces defaults to 32 random bytes generated for each request.
+	nonces nonceSource
+}
+
+func noncedHeaderTemplate(name string) string {
+	return "header:" + name
 }
 
 func (r NoncedRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	nonce, err := r.generateNonce()
+	if req.Method == http.MethodHead {
+		r.serveHead(w, req)
+		return
+	}
+
+	nonce, err := r.generateNonce(req)
 	log := zap.L().With(zap.String("route", r.name))
 
 	if err != nil {
@@ -158,6 +185,11 @@ func (r NoncedRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	comp := r.findCompression(req)
 
+	if r.page != nil {
+		r.serveSpliced(w, req, comp, nonce)
+		return
+	}
+
 	response := bytes.NewBuffer(nil)
 	csp := bytes.NewBuffer(nil)
 
@@ -182,15 +214,68 @@ func (r NoncedRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	headers := make([]string, len(r.headers))
+	for i, name := range r.headers {
+		value := bytes.NewBuffer(nil)
+		err = r.template.ExecuteTemplate(value, noncedHeaderTemplate(name), nonce)
+		if err != nil {
+			log.Warn("could not execute header template",
+				zap.String("header", name),
+				zap.Error(err))
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		headers[i] = value.String()
+	}
+
+	r.writeResponse(w, req, comp, csp.String(), headers, response.Bytes())
+}
+
+func (r NoncedRoute) serveSpliced(w http.ResponseWriter, req *http.Request, comp Compression, nonce Nonce) {
+	response, err := r.page.Render(comp, nonce.Nonce)
+	if err != nil {
+		zap.L().Error("could not render response",
+			zap.String("route", r.name),
+			zap.Error(err))
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	headers := make([]string, len(r.headers))
+	for i, header := range r.page.headers {
+		headers[i] = header.Splice(nonce.Nonce)
+	}
+
+	r.writeResponse(w, req, comp, r.page.csp.Splice(nonce.Nonce), headers, response)
+}
+
+func (r NoncedRoute) writeResponse(w http.ResponseWriter, req *http.Request, comp Compression, csp string, headers []string, response []byte) {
 	w.Header().Add("Cache-Control", "no-store")
 	comp.WriteEncodingHeader(w)
-	w.Header().Add("Content-Security-Policy", string(csp.Bytes()))
+	w.Header().Add("Content-Security-Policy", csp)
+	for i, name := range r.headers {
+		w.Header().Add(name, headers[i])
+	}
+
+	http.ServeContent(w, req, r.name, time.Now(), bytes.NewReader(response))
+}
 
-	http.ServeContent(w, req, r.name, time.Now(), bytes.NewReader(response.Bytes()))
+// serveHead answers HEAD requests without generating a nonce nor
+// rendering the content. The CSP and nonced headers are omitted, as
+// they would only be valid for a body that is never sent.
+func (r NoncedRoute) serveHead(w http.ResponseWriter, req *http.Request) {
+	w.Header().Add("Cache-Control", "no-store")
+	if len(r.mime) > 0 {
+		w.Header().Set("Content-Type", r.mime)
+	}
+	r.findCompression(req).WriteEncodingHeader(w)
+	w.WriteHeader(http.StatusOK)
 }
 
+// Nonce is the data available to nonced route templates.
 type Nonce struct {
-	Nonce string
+	Nonce   string
+	Request *http.Request
 }
 
 func (r NoncedRoute) Flags() RouteFlag {
@@ -198,13 +283,23 @@ func (r NoncedRoute) Flags() RouteFlag {
 }
 
 func (r NoncedRoute) PreCache() int64 {
-	return 0
+	if r.page == nil {
+		return 0
+	}
+	return r.page.Size()
 }
 
-func (r NoncedRoute) generateNonce() (Nonce, error) {
-	nonce := make([]byte, 32)
-	if _, err := rand.Read(nonce); err != nil {
+func (r NoncedRoute) generateNonce(req *http.Request) (Nonce, error) {
+	nonces := r.nonces
+	if nonces == nil {
+		nonces = randomNonces{length: defaultNonceLength}
+	}
+	nonce, err := nonces.Nonce()
+	if err != nil {
 		return Nonce{}, err
 	}
-	return Nonce{base64.RawURLEncoding.EncodeToString(nonce)}, nil
+	return Nonce{
+		Nonce:   nonce,
+		Request: req,
+	}, nil
 }
@@ -452,3 +452,48 @@ func (s *RoutesSuite) TestNoncedRouteFailure(c *C) {
 	c.Assert(logs[0].Context[1].Interface, ErrorMatches, `template: CSP:.*: executing "CSP" at \<\.N\>: .*`)
 
 }
+
+func (s *RoutesSuite) TestNoncedRouteHeaders(c *C) {
+	tmpl := template.Must(template.New("CSP").Parse(`script-src 'nonce-{{.Nonce}}'`))
+	tmpl = template.Must(tmpl.New("content").Parse(`<html><head><meta property="csp-nonce" nonce="{{.Nonce}}"></head></html>`))
+	tmpl = template.Must(tmpl.New(noncedHeaderTemplate("Link")).Parse(`</main.js>; rel=preload; as=script; nonce={{.Nonce}}`))
+	tmpl = template.Must(tmpl.New(noncedHeaderTemplate("X-Host")).Parse(`{{.Request.Host}}`))
+
+	r := NoncedRoute{
+		route:    route{"index.html", "text/html; charset=utf-8", nil},
+		template: tmpl,
+		headers:  []string{"Link", "X-Host"},
+	}
+
+	w := NewMockResponseWritter()
+	req, err := http.NewRequest("GET", "http://example.com/index.html", bytes.NewBuffer(nil))
+	c.Assert(err, IsNil)
+	r.ServeHTTP(w, req)
+
+	rx := regexp.MustCompile("HTTP/1.1 200 Ok\r\n" +
+		"Accept-Ranges: bytes\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"Content-Length: [0-9]+\r\n" +
+		"Content-Security-Policy: script-src 'nonce-(.*)'\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Last-Modified: .* GMT\r\n" +
+		"Link: </main.js>; rel=preload; as=script; nonce=(.*)\r\n" +
+		"X-Host: example.com\r\n\r\n" +
+		"<html><head><meta property=\"csp-nonce\" nonce=\"(.*)\"></head></html>")
+
+	m := rx.FindAllStringSubmatch(string(w.buffer.Bytes()), -1)
+	c.Assert(len(m), Equals, 1, Commentf("%s", w.buffer.Bytes()))
+	c.Assert(len(m[0]), Equals, 4)
+	c.Check(m[0][1], Equals, m[0][2])
+	c.Check(m[0][1], Equals, m[0][3])
+
+	tmpl = template.Must(tmpl.New(noncedHeaderTemplate("X-Host")).Parse(`{{.Request.N}}`))
+	r.template = tmpl
+	w = NewMockResponseWritter()
+	r.ServeHTTP(w, req)
+	c.Check(w.buffer.Bytes(), ResponseMatches, []string{"HTTP/1.1 500 Ok"})
+	logs := s.logs.TakeAll()
+	c.Assert(logs, HasLen, 1)
+	c.Check(logs[0].Message, Equals, "could not execute header template")
+	c.Check(logs[0].Context[1], Equals, zap.String("header", "X-Host"))
+}
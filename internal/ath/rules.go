@@ -0,0 +1,243 @@
+package ath
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+)
+
+// RuleConfig is a redirect or rewrite rule of a --rules file.
+type RuleConfig struct {
+	// Match is 'exact' (the default), 'prefix' or 'regex'.
+	Match string `json:"match"`
+	Path  string `json:"path"`
+	// Host restricts the rule to a host name or wildcard.
+	Host string `json:"host"`
+
+	Redirect string `json:"redirect"`
+	Status   int    `json:"status"`
+	Rewrite  string `json:"rewrite"`
+}
+
+type RulesConfig struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+var redirectStatuses = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusSeeOther,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+type rule struct {
+	RuleConfig
+	rx *regexp.Regexp
+	// absolute is set for redirects to absolute URLs, which may
+	// leave the host.
+	absolute bool
+}
+
+// isAbsoluteTemplate reports if the literal start of template is an
+// absolute or scheme relative URL.
+func isAbsoluteTemplate(template string) bool {
+	literal, _, _ := strings.Cut(template, "$")
+	return strings.Contains(literal, "://") || strings.HasPrefix(literal, "//")
+}
+
+// localTarget returns the expansion of a non absolute template,
+// collapsing its leading slashes so that a captured '//evil.com'
+// does not redirect to another host. It returns false if target
+// still is an URL with a host or scheme.
+func localTarget(target string) (string, bool) {
+	if strings.HasPrefix(target, "/") || strings.HasPrefix(target, `\`) {
+		// browsers handle '\' as '/'.
+		target = "/" + strings.TrimLeft(target, `/\`)
+	}
+	u, err := url.Parse(target)
+	if err != nil || len(u.Scheme) > 0 || len(u.Host) > 0 {
+		return "", false
+	}
+	return target, true
+}
+
+// templateRefRx matches the references of a regexp.Expand template.
+var templateRefRx = regexp.MustCompile(`\$(\$|\{[^}]*\}|[[:word:]]+)`)
+
+func validateTemplate(rx *regexp.Regexp, template string) error {
+	for _, m := range templateRefRx.FindAllStringSubmatch(template, -1) {
+		name := strings.TrimSuffix(strings.TrimPrefix(m[1], "{"), "}")
+		if name == "$" {
+			continue
+		}
+		if n, err := strconv.Atoi(name); err == nil {
+			if n > rx.NumSubexp() {
+				return fmt.Errorf("'%s' references missing group '%s'", template, m[0])
+			}
+			continue
+		}
+		if slices.Contains(rx.SubexpNames(), name) == false {
+			return fmt.Errorf("'%s' references missing group '%s'", template, m[0])
+		}
+	}
+	return nil
+}
+
+func newRule(config RuleConfig) (rule, error) {
+	res := rule{RuleConfig: config}
+	var err error
+	switch config.Match {
+	case "", "exact":
+		res.rx, err = regexp.Compile(`\A` + regexp.QuoteMeta(config.Path) + `\z`)
+	case "prefix":
+		// the rest of the path is the first group.
+		res.rx, err = regexp.Compile(`\A` + regexp.QuoteMeta(config.Path) + `(.*)\z`)
+	case "regex":
+		res.rx, err = regexp.Compile(config.Path)
+	default:
+		return rule{}, fmt.Errorf("invalid match '%s', expected 'exact', 'prefix' or 'regex'", config.Match)
+	}
+	if err != nil {
+		return rule{}, fmt.Errorf("invalid path '%s': %w", config.Path, err)
+	}
+	if config.Match != "regex" && strings.HasPrefix(config.Path, "/") == false {
+		return rule{}, fmt.Errorf("invalid path '%s', expected an absolute path", config.Path)
+	}
+	if len(config.Host) > 0 {
+		if err := validateHostPattern(config.Host); err != nil {
+			return rule{}, err
+		}
+	}
+
+	if (len(config.Redirect) > 0) == (len(config.Rewrite) > 0) {
+		return rule{}, fmt.Errorf("rule '%s' needs either a redirect or a rewrite", config.Path)
+	}
+	if len(config.Rewrite) > 0 {
+		if config.Status != 0 {
+			return rule{}, fmt.Errorf("rule '%s': status is only valid for redirects", config.Path)
+		}
+		if strings.HasPrefix(config.Rewrite, "/") == false {
+			return rule{}, fmt.Errorf("rule '%s': invalid rewrite '%s', expected an absolute path", config.Path, config.Rewrite)
+		}
+		return res, validateTemplate(res.rx, config.Rewrite)
+	}
+	res.absolute = isAbsoluteTemplate(config.Redirect)
+	if res.Status == 0 {
+		res.Status = http.StatusFound
+	}
+	if slices.Contains(redirectStatuses, res.Status) == false {
+		return rule{}, fmt.Errorf("rule '%s': invalid redirect status %d", config.Path, res.Status)
+	}
+	return res, validateTemplate(res.rx, config.Redirect)
+}
+
+func (r rule) matchHost(host string) bool {
+	if len(r.Host) == 0 || r.Host == "*" {
+		return true
+	}
+	if strings.HasPrefix(r.Host, "*.") == true {
+		return strings.HasSuffix(host, r.Host[1:])
+	}
+	return host == r.Host
+}
+
+// apply returns the redirect or rewrite of p, or false if the rule
+// does not match.
+func (r rule) apply(host, p string) (string, bool) {
+	if r.matchHost(host) == false {
+		return "", false
+	}
+	m := r.rx.FindStringSubmatchIndex(p)
+	if m == nil {
+		return "", false
+	}
+	template := r.Redirect
+	if len(r.Rewrite) > 0 {
+		template = r.Rewrite
+	}
+	target := string(r.rx.ExpandString(nil, template, p, m))
+	if r.absolute == true {
+		return target, true
+	}
+	return localTarget(target)
+}
+
+func (r rule) isStatic() bool {
+	return strings.Contains(r.Rewrite, "$") == false
+}
+
+// rules are evaluated in order on request paths, before the base
+// href and route lookup. The first matching rule wins.
+type rules []rule
+
+func loadRules(path string) (rules, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	config := RulesConfig{}
+	if err := loadJSONFile(path, &config); err != nil {
+		return nil, err
+	}
+	res := make(rules, len(config.Rules))
+	for i, c := range config.Rules {
+		var err error
+		if res[i], err = newRule(c); err != nil {
+			return nil, fmt.Errorf("'%s': rule %d: %w", path, i, err)
+		}
+	}
+	return res, nil
+}
+
+// WithRules evaluates redirect and rewrite rules before route lookup.
+func WithRules(rules rules) HandlerOption {
+	return func(h *Handler) {
+		h.rules = rules
+	}
+}
+
+// validateRewrites checks that rewrites without substitution target
+// an existing route of h.
+func (h *Handler) validateRewrites() error {
+	for _, r := range h.rules {
+		if len(r.Rewrite) == 0 || r.isStatic() == false {
+			continue
+		}
+		p, ok := h.appPath(r.Rewrite)
+		if ok == false {
+			return fmt.Errorf("rule '%s': rewrite '%s' is outside of --base-href", r.Path, r.Rewrite)
+		}
+		if _, ok := h.routes[h.target(p)]; ok == false {
+			return fmt.Errorf("rule '%s': rewrite '%s' is not an existing file", r.Path, r.Rewrite)
+		}
+	}
+	return nil
+}
+
+// applyRules redirects req and returns true, or returns req with its
+// path rewritten, if a rule matches.
+func (h *Handler) applyRules(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	host := normalizeHost(req.Host)
+	for _, r := range h.rules {
+		target, ok := r.apply(host, req.URL.Path)
+		if ok == false {
+			continue
+		}
+		if len(r.Rewrite) > 0 {
+			h.log(req).Debug("rewrite", zap.String("target", target))
+			return withPath(req, target), false
+		}
+		if strings.Contains(target, "?") == false {
+			target += query(req)
+		}
+		http.Redirect(w, req, target, r.Status)
+		return req, true
+	}
+	return req, false
+}
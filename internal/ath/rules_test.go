@@ -0,0 +1,207 @@
+package ath
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type RulesSuite struct{}
+
+var _ = Suite(&RulesSuite{})
+
+func (s *RulesSuite) TestValidation(c *C) {
+	testdata := []struct {
+		Rule  RuleConfig
+		Error string
+	}{
+		{RuleConfig{Path: "/old", Redirect: "/new"}, ""},
+		{RuleConfig{Match: "prefix", Path: "/docs/", Rewrite: "/docs/index.html"}, ""},
+		{RuleConfig{Match: "regex", Path: `\A/users/(?P<id>\d+)\z`, Redirect: "/profiles/${id}", Status: 308}, ""},
+		{RuleConfig{Match: "glob", Path: "/old", Redirect: "/new"},
+			"invalid match 'glob', expected 'exact', 'prefix' or 'regex'"},
+		{RuleConfig{Path: "old", Redirect: "/new"}, "invalid path 'old', expected an absolute path"},
+		{RuleConfig{Match: "regex", Path: "/(", Redirect: "/new"}, "invalid path '/\\(': .*"},
+		{RuleConfig{Path: "/old"}, "rule '/old' needs either a redirect or a rewrite"},
+		{RuleConfig{Path: "/old", Redirect: "/new", Rewrite: "/new"}, "rule '/old' needs either a redirect or a rewrite"},
+		{RuleConfig{Path: "/old", Redirect: "/new", Status: 200}, "rule '/old': invalid redirect status 200"},
+		{RuleConfig{Path: "/old", Rewrite: "/new", Status: 301}, "rule '/old': status is only valid for redirects"},
+		{RuleConfig{Path: "/old", Rewrite: "new"}, "rule '/old': invalid rewrite 'new', expected an absolute path"},
+		{RuleConfig{Path: "/old", Redirect: "/new/$1"}, "'/new/\\$1' references missing group '\\$1'"},
+		{RuleConfig{Match: "regex", Path: `/(\d+)`, Redirect: "/new/${id}"}, "'/new/\\$\\{id\\}' references missing group '\\$\\{id\\}'"},
+		{RuleConfig{Match: "prefix", Path: "/old/", Redirect: "/new/$1?price=$$5"}, ""},
+		{RuleConfig{Path: "/old", Host: "www.*", Redirect: "/new"}, "invalid host 'www.\\*', .*"},
+	}
+	for _, d := range testdata {
+		_, err := newRule(d.Rule)
+		if len(d.Error) == 0 {
+			c.Check(err, IsNil, Commentf("%+v", d.Rule))
+		} else {
+			c.Check(err, ErrorMatches, d.Error, Commentf("%+v", d.Rule))
+		}
+	}
+}
+
+func (s *RulesSuite) TestApply(c *C) {
+	testdata := []struct {
+		Rule       RuleConfig
+		Host, Path string
+		Expected   string
+		Matches    bool
+	}{
+		{RuleConfig{Path: "/old", Redirect: "/new"}, "example.com", "/old", "/new", true},
+		{RuleConfig{Path: "/old", Redirect: "/new"}, "example.com", "/old/", "", false},
+		{RuleConfig{Match: "prefix", Path: "/blog/", Redirect: "https://blog.example.com/$1"},
+			"example.com", "/blog/2023/hello", "https://blog.example.com/2023/hello", true},
+		{RuleConfig{Match: "prefix", Path: "/", Host: "www.example.com", Redirect: "https://example.com/$1"},
+			"www.example.com", "/pricing", "https://example.com/pricing", true},
+		{RuleConfig{Match: "prefix", Path: "/", Host: "www.example.com", Redirect: "https://example.com/$1"},
+			"example.com", "/pricing", "", false},
+		{RuleConfig{Match: "prefix", Path: "/", Host: "*.example.com", Redirect: "/"},
+			"acme.example.com", "/", "/", true},
+		{RuleConfig{Match: "regex", Path: `\A/users/(?P<id>\d+)\z`, Redirect: "/profiles/${id}"},
+			"example.com", "/users/42", "/profiles/42", true},
+		{RuleConfig{Match: "regex", Path: `\A/users/(?P<id>\d+)\z`, Redirect: "/profiles/${id}"},
+			"example.com", "/users/john", "", false},
+		{RuleConfig{Match: "regex", Path: `\A/(fr|en)/docs/`, Rewrite: "/$1/docs/index.html"},
+			"example.com", "/fr/docs/install", "/fr/docs/index.html", true},
+		// captured paths can not redirect to another host.
+		{RuleConfig{Match: "prefix", Path: "/old/", Redirect: "/$1"},
+			"example.com", "/old//evil.com", "/evil.com", true},
+		{RuleConfig{Match: "prefix", Path: "/old/", Redirect: "/$1"},
+			"example.com", `/old/\\evil.com`, "/evil.com", true},
+		{RuleConfig{Match: "prefix", Path: "/old/", Redirect: "$1"},
+			"example.com", "/old/https://evil.com", "", false},
+		{RuleConfig{Match: "prefix", Path: "/old/", Rewrite: "/$1"},
+			"example.com", "/old//index.html", "/index.html", true},
+		{RuleConfig{Match: "prefix", Path: "/out/", Redirect: "https://$1"},
+			"example.com", "/out/partner.example.org/", "https://partner.example.org/", true},
+	}
+	for _, d := range testdata {
+		r, err := newRule(d.Rule)
+		c.Assert(err, IsNil)
+		res, ok := r.apply(d.Host, d.Path)
+		c.Check(ok, Equals, d.Matches, Commentf("%+v %s%s", d.Rule, d.Host, d.Path))
+		c.Check(res, Equals, d.Expected, Commentf("%+v %s%s", d.Rule, d.Host, d.Path))
+	}
+}
+
+func (s *RulesSuite) TestLoad(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "rules.json")
+	c.Assert(os.WriteFile(path, []byte(`{"rules":[
+{"path":"/old","redirect":"/new","status":301},
+{"match":"prefix","path":"/docs/","rewrite":"/docs/index.html"}
+]}`), 0644), IsNil)
+	res, err := loadRules(path)
+	c.Assert(err, IsNil)
+	c.Check(res, HasLen, 2)
+
+	c.Assert(os.WriteFile(path, []byte(`{"rules":[{"path":"/old","redirect":"/new"},{"path":"/old"}]}`), 0644), IsNil)
+	_, err = loadRules(path)
+	c.Check(err, ErrorMatches, "'.*rules.json': rule 1: rule '/old' needs either a redirect or a rewrite")
+
+	res, err = loadRules("")
+	c.Check(err, IsNil)
+	c.Check(res, IsNil)
+}
+
+func (s *RulesSuite) TestHandler(c *C) {
+	dir := writeBundle(c, map[string]string{
+		"index.html":      "<html><body>app</body></html>",
+		"docs/index.html": "<html><body>docs</body></html>",
+	})
+	rulesPath := filepath.Join(c.MkDir(), "rules.json")
+	c.Assert(os.WriteFile(rulesPath, []byte(`{"rules":[
+{"path":"/old","redirect":"/new","status":301},
+{"match":"prefix","path":"/","host":"www.example.com","redirect":"https://example.com/$1","status":308},
+{"match":"prefix","path":"/docs/","rewrite":"/docs/index.html"},
+{"path":"/search","redirect":"/find?from=search"},
+{"match":"prefix","path":"/moved/","redirect":"/$1"}
+]}`), 0644), IsNil)
+
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{dir, "--csp.nonce-disable", "--rules", rulesPath})
+	c.Assert(err, IsNil)
+	_, h, err := buildHandler(config, nil)
+	c.Assert(err, IsNil)
+
+	testdata := []struct {
+		Host, Target string
+		Status       int
+		Location     string
+		Body         string
+	}{
+		{"example.com", "/old?x=1", 301, "/new?x=1", ""},
+		{"www.example.com", "/pricing?x=1", 308, "https://example.com/pricing?x=1", ""},
+		{"example.com", "/docs/install/linux", 200, "", "<html><body>docs</body></html>"},
+		{"example.com", "/search?q=go", 302, "/find?from=search", ""},
+		{"example.com", "/moved//evil.com", 302, "/evil.com", ""},
+		{"example.com", "/dashboard", 200, "", "<html><body>app</body></html>"},
+	}
+	for _, d := range testdata {
+		req := httptest.NewRequest("GET", d.Target, nil)
+		req.Host = d.Host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		c.Check(w.Code, Equals, d.Status, Commentf("%s%s", d.Host, d.Target))
+		c.Check(w.Header().Get("Location"), Equals, d.Location, Commentf("%s%s", d.Host, d.Target))
+		if len(d.Body) > 0 {
+			c.Check(w.Body.String(), Equals, d.Body, Commentf("%s%s", d.Host, d.Target))
+		}
+	}
+
+	// redirects precede the method and client certificate checks.
+	_, h, err = buildHandler(config, nil, WithClientAuth([]string{"/docs/**"}))
+	c.Assert(err, IsNil)
+	for _, method := range []string{"POST", "OPTIONS"} {
+		req := httptest.NewRequest(method, "/pricing", nil)
+		req.Host = "www.example.com"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		c.Check(w.Code, Equals, 308, Commentf("%s", method))
+		c.Check(w.Header().Get("Location"), Equals, "https://example.com/pricing", Commentf("%s", method))
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/dashboard", nil))
+	c.Check(w.Code, Equals, http.StatusForbidden)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/docs/install", nil))
+	c.Check(w.Code, Equals, http.StatusMethodNotAllowed)
+
+	c.Assert(os.WriteFile(rulesPath, []byte(`{"rules":[
+{"match":"prefix","path":"/guide/","rewrite":"/guide/index.html"}
+]}`), 0644), IsNil)
+	_, _, err = buildHandler(config, nil)
+	c.Check(err, ErrorMatches, "'.*rules.json': rule '/guide/': rewrite '/guide/index.html' is not an existing file")
+}
+
+func (s *RulesSuite) TestBaseHref(c *C) {
+	h := NewHandler(map[string]Route{
+		"/admin/index.html":      flaggedRoute(NONCED),
+		"/admin/docs/index.html": flaggedRoute(IMMUTABLE),
+	}, WithBaseHref("/admin", false))
+
+	r, err := newRule(RuleConfig{Match: "prefix", Path: "/admin/docs/", Rewrite: "/admin/docs/index.html"})
+	c.Assert(err, IsNil)
+	h.rules = rules{r}
+	c.Check(h.validateRewrites(), IsNil)
+
+	r, err = newRule(RuleConfig{Match: "prefix", Path: "/docs/", Rewrite: "/docs/index.html"})
+	c.Assert(err, IsNil)
+	h.rules = rules{r}
+	c.Check(h.validateRewrites(), ErrorMatches, "rule '/docs/': rewrite '/docs/index.html' is outside of --base-href")
+
+	// rules apply before the base href.
+	r, err = newRule(RuleConfig{Path: "/old-admin", Redirect: "/admin/", Status: 301})
+	c.Assert(err, IsNil)
+	h.rules = rules{r}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/old-admin", nil))
+	c.Check(w.Code, Equals, http.StatusMovedPermanently)
+	c.Check(w.Header().Get("Location"), Equals, "/admin/")
+}
@@ -0,0 +1,123 @@
+package ath
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/exp/maps"
+)
+
+// SecurityHeaders maps header names to their values. An empty value
+// removes the header.
+type SecurityHeaders map[string]string
+
+type PathSecurityHeaders struct {
+	Path    string          `json:"path"`
+	Headers SecurityHeaders `json:"headers"`
+}
+
+type SecurityHeadersConfig struct {
+	Headers SecurityHeaders       `json:"headers"`
+	Paths   []PathSecurityHeaders `json:"paths"`
+}
+
+var SecurityHeadersPresets = map[string]SecurityHeaders{
+	"none": {},
+	// default only sets headers that can not break an application,
+	// e.g. served over plain HTTP, embedded or loading cross-origin
+	// resources.
+	"default": {
+		"X-Content-Type-Options": "nosniff",
+	},
+	"strict": {
+		"Strict-Transport-Security":    "max-age=63072000; includeSubDomains; preload",
+		"X-Content-Type-Options":       "nosniff",
+		"X-Frame-Options":              "DENY",
+		"Referrer-Policy":              "no-referrer",
+		"Permissions-Policy":           "accelerometer=(), camera=(), geolocation=(), gyroscope=(), magnetometer=(), microphone=(), payment=(), usb=()",
+		"Cross-Origin-Opener-Policy":   "same-origin",
+		"Cross-Origin-Embedder-Policy": "require-corp",
+		"Cross-Origin-Resource-Policy": "same-origin",
+	},
+}
+
+func (h SecurityHeaders) merge(overrides SecurityHeaders) SecurityHeaders {
+	res := maps.Clone(h)
+	if res == nil {
+		res = make(SecurityHeaders)
+	}
+	for name, value := range overrides {
+		res[http.CanonicalHeaderKey(name)] = value
+	}
+	return res
+}
+
+// For returns the headers to set on a response for the URL path p.
+func (c SecurityHeadersConfig) For(p string) SecurityHeaders {
+	res := c.Headers
+	for _, override := range c.Paths {
+		if matchGlob(override.Path, p) == true {
+			res = res.merge(override.Headers)
+		}
+	}
+	return res
+}
+
+func (c SecurityHeadersConfig) Apply(header http.Header, p string) {
+	for name, value := range c.For(p) {
+		if len(value) > 0 {
+			header.Set(name, value)
+		}
+	}
+}
+
+func (c SecurityHeadersConfig) Validate() error {
+	for name := range c.Headers {
+		if headerNameRx.MatchString(name) == false {
+			return fmt.Errorf("invalid header name '%s'", name)
+		}
+	}
+	for _, override := range c.Paths {
+		if err := validateGlob(override.Path); err != nil {
+			return err
+		}
+		for name := range override.Headers {
+			if headerNameRx.MatchString(name) == false {
+				return fmt.Errorf("invalid header name '%s' for '%s'", name, override.Path)
+			}
+		}
+	}
+	return nil
+}
+
+func loadSecurityHeaders(config Config) (SecurityHeadersConfig, error) {
+	preset, ok := SecurityHeadersPresets[config.SecurityHeaders.Preset]
+	if ok == false {
+		return SecurityHeadersConfig{}, fmt.Errorf("unknown security headers preset '%s'", config.SecurityHeaders.Preset)
+	}
+
+	res := SecurityHeadersConfig{}
+	if len(config.SecurityHeaders.ConfigFile) > 0 {
+		if err := loadJSONFile(config.SecurityHeaders.ConfigFile, &res); err != nil {
+			return SecurityHeadersConfig{}, err
+		}
+	}
+
+	flags := SecurityHeaders{}
+	for name, value := range map[string]string{
+		"Strict-Transport-Security":    config.SecurityHeaders.HSTS,
+		"Referrer-Policy":              config.SecurityHeaders.ReferrerPolicy,
+		"Permissions-Policy":           config.SecurityHeaders.PermissionsPolicy,
+		"Cross-Origin-Opener-Policy":   config.SecurityHeaders.COOP,
+		"Cross-Origin-Embedder-Policy": config.SecurityHeaders.COEP,
+		"Cross-Origin-Resource-Policy": config.SecurityHeaders.CORP,
+	} {
+		if len(value) > 0 {
+			flags[name] = value
+		}
+	}
+
+	res.Headers = preset.merge(flags).merge(res.Headers)
+
+	return res, res.Validate()
+}
@@ -0,0 +1,74 @@
+package ath
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type SecurityHeadersSuite struct{}
+
+var _ = Suite(&SecurityHeadersSuite{})
+
+func (s *SecurityHeadersSuite) TestPresets(c *C) {
+	for _, preset := range []string{"none", "default", "strict"} {
+		var config Config
+		_, err := flags.ParseArgs(&config, []string{"--headers.preset", preset})
+		c.Assert(err, IsNil)
+		headers, err := loadSecurityHeaders(config)
+		c.Assert(err, IsNil)
+		c.Check(headers.Headers, DeepEquals, SecurityHeadersPresets[preset])
+	}
+
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"--headers.preset", "foo"})
+	c.Check(err, ErrorMatches, "Invalid value `foo' for option `--headers.preset'.*")
+}
+
+func (s *SecurityHeadersSuite) TestOverrides(c *C) {
+	path := filepath.Join(c.MkDir(), "headers.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`{
+  "headers": { "x-frame-options": "SAMEORIGIN" },
+  "paths": [
+    { "path": "/assets/**", "headers": { "Cross-Origin-Resource-Policy": "cross-origin" } },
+    { "path": "/healthz", "headers": { "Strict-Transport-Security": "" } }
+  ]
+}`), 0644), IsNil)
+
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{
+		"--headers.config", path,
+		"--headers.referrer-policy", "no-referrer",
+		"--headers.hsts", "max-age=31536000",
+	})
+	c.Assert(err, IsNil)
+	headers, err := loadSecurityHeaders(config)
+	c.Assert(err, IsNil)
+
+	expected := SecurityHeaders{
+		"Strict-Transport-Security": "max-age=31536000",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Referrer-Policy":           "no-referrer",
+	}
+	c.Check(headers.For("/index.html"), DeepEquals, expected)
+	c.Check(headers.For("/assets/logo.svg")["Cross-Origin-Resource-Policy"], Equals, "cross-origin")
+	c.Check(headers.For("/index.html"), DeepEquals, expected)
+
+	header := http.Header{}
+	headers.Apply(header, "/healthz")
+	c.Check(header.Get("Strict-Transport-Security"), Equals, "")
+	c.Check(header.Values("Strict-Transport-Security"), HasLen, 0)
+	c.Check(header.Get("X-Frame-Options"), Equals, "SAMEORIGIN")
+
+	c.Assert(ioutil.WriteFile(path, []byte(`{"paths": [{"path": "assets/**", "headers": {}}]}`), 0644), IsNil)
+	_, err = loadSecurityHeaders(config)
+	c.Check(err, ErrorMatches, "invalid pattern 'assets/\\*\\*': should start with '/'")
+
+	c.Assert(ioutil.WriteFile(path, []byte(`{"headers": {"X Frame": "DENY"}}`), 0644), IsNil)
+	_, err = loadSecurityHeaders(config)
+	c.Check(err, ErrorMatches, "invalid header name 'X Frame'")
+}
@@ -0,0 +1,153 @@
+package ath
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+)
+
+func serveAll(listeners []net.Listener, serve func(net.Listener) error, errs chan<- error) {
+	for _, l := range listeners {
+		zap.L().Info("listening", zap.Stringer("address", l.Addr()))
+		go func(l net.Listener) {
+			errs <- serve(l)
+		}(l)
+	}
+}
+
+func listenAndServe(config Config, handler http.Handler) error {
+	if err := validateServerLimits(config); err != nil {
+		return err
+	}
+	if err := validateTLS(config); err != nil {
+		return err
+	}
+	redirectAddrs, httpsPort, err := redirectAddresses(config)
+	if err != nil {
+		return err
+	}
+	var http3Addrs []string
+	var http3Port int
+	if config.Protocol.HTTP3 == true {
+		var err error
+		if http3Addrs, http3Port, err = http3Addresses(config); err != nil {
+			return err
+		}
+	}
+	limiter := newConnectionLimiter(config.Server.MaxConnections)
+
+	resolver, err := newForwardedResolver(config)
+	if err != nil {
+		return err
+	}
+	unresolved := handler
+	if resolver != nil {
+		handler = withForwarded(handler, resolver)
+	}
+
+	if config.TLSEnabled() == false {
+		if config.Protocol.H2C == true {
+			handler = withH2C(config, handler)
+		}
+		listeners, err := openListeners(config)
+		if err != nil {
+			return err
+		}
+		listeners = limiter.wrapAll(listeners)
+		server := newHTTPServer(config, handler)
+		errs := make(chan error, len(listeners))
+		serveAll(listeners, server.Serve, errs)
+		return <-errs
+	}
+
+	var getters []certificateGetter
+	var redirect http.Handler = httpsRedirectHandler{port: httpsPort}
+	if resolver != nil {
+		// requests already received over HTTPS by a trusted proxy
+		// are served directly.
+		redirect = withForwarded(httpsRedirectHandler{port: httpsPort, next: unresolved}, resolver)
+	}
+	nextProtos := []string{}
+
+	if len(config.ACME.Domains) > 0 {
+		manager, err := newACMEManager(config)
+		if err != nil {
+			return err
+		}
+		getters = append(getters, manager.GetCertificate)
+		// the HTTP listener only answers HTTP-01 challenges.
+		redirect = manager.HTTPHandler(redirect)
+		nextProtos = append(nextProtos, acme.ALPNProto)
+		if config.TLS.HTTPPort == 0 {
+			zap.L().Warn("no --tls.http-port, only TLS-ALPN-01 ACME challenges are available")
+		}
+	}
+
+	if len(config.TLS.Cert) > 0 || len(config.TLS.SNIDirectory) > 0 {
+		store, err := newCertificateStore(config.TLS.Cert, config.TLS.Key, config.TLS.SNIDirectory)
+		if err != nil {
+			return err
+		}
+		stop := make(chan struct{})
+		defer close(stop)
+		go store.watch(config.TLS.ReloadInterval, stop)
+		getters = append(getters, store.GetCertificate)
+	}
+
+	listeners, err := openListeners(config)
+	if err != nil {
+		return err
+	}
+	listeners = limiter.wrapAll(listeners)
+
+	errs := make(chan error, len(listeners)+len(http3Addrs)+len(redirectAddrs))
+
+	redirectServer := newHTTPServer(config, redirect)
+	for _, address := range redirectAddrs {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		zap.L().Info("redirecting HTTP to HTTPS",
+			zap.String("address", address),
+			zap.Int("port", httpsPort))
+		go func() {
+			errs <- redirectServer.Serve(limiter.wrap(l))
+		}()
+	}
+
+	tlsConfig := newTLSConfig(chainCertificateGetters(getters...))
+	if len(config.TLS.ClientCA) > 0 {
+		if err := configureClientAuth(tlsConfig, config.TLS.ClientCA); err != nil {
+			return err
+		}
+	}
+
+	if config.Protocol.HTTP3 == true {
+		var altSvc *http3.Server
+		for _, address := range http3Addrs {
+			http3Server := newHTTP3Server(address, http3Port, handler, tlsConfig)
+			limitHTTP3Server(config, http3Server)
+			defer http3Server.Close()
+			altSvc = http3Server
+			zap.L().Info("listening for HTTP/3", zap.String("address", address))
+			go func() {
+				errs <- http3Server.ListenAndServe()
+			}()
+		}
+		// listeners share a port, any server advertises it.
+		handler = altSvcHandler{handler: handler, server: altSvc}
+	}
+
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, nextProtos...)
+	server := newHTTPServer(config, handler)
+	server.TLSConfig = tlsConfig
+	serveAll(listeners, func(l net.Listener) error {
+		return server.ServeTLS(l, "", "")
+	}, errs)
+
+	return <-errs
+}
@@ -0,0 +1,384 @@
+package ath
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// SiteConfig describes one application served by a multi-site
+// server. Unset fields default to the command line options.
+type SiteConfig struct {
+	Name          string   `json:"name"`
+	Directory     string   `json:"directory"`
+	BaseHref      string   `json:"base-href"`
+	StripBaseHref bool     `json:"strip-base-href"`
+	Hosts         []string `json:"hosts"`
+	CacheSize     ByteSize `json:"cache-size"`
+	Previous      []string `json:"previous"`
+	ErrorPages    string   `json:"error-pages"`
+	Rules         string   `json:"rules"`
+	Mounts        string   `json:"mounts"`
+
+	CSP struct {
+		Disable    bool     `json:"disable"`
+		Policy     string   `json:"policy"`
+		ConfigFile string   `json:"config"`
+		Nonced     []string `json:"nonced"`
+	} `json:"csp"`
+}
+
+type SitesConfig struct {
+	// MaxMemorySize is shared by the caches of all sites, and
+	// defaults to --server-cache.max-size.
+	MaxMemorySize ByteSize          `json:"max-memory-size"`
+	UnknownHost   UnknownHostConfig `json:"unknown-host"`
+	Sites         []SiteConfig      `json:"sites"`
+}
+
+func loadSitesConfig(path string) (SitesConfig, error) {
+	res := SitesConfig{}
+	if err := loadJSONFile(path, &res); err != nil {
+		return SitesConfig{}, err
+	}
+	if len(res.Sites) == 0 {
+		return SitesConfig{}, fmt.Errorf("'%s' defines no site", path)
+	}
+	if err := res.UnknownHost.validate(); err != nil {
+		return SitesConfig{}, err
+	}
+
+	// relative paths are relative to the sites file.
+	dir := filepath.Dir(path)
+	relative := func(p string) string {
+		if len(p) == 0 || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	names := make(map[string]bool)
+	for i := range res.Sites {
+		site := &res.Sites[i]
+		if len(site.Name) == 0 {
+			return SitesConfig{}, fmt.Errorf("site %d has no name", i)
+		}
+		if names[site.Name] == true {
+			return SitesConfig{}, fmt.Errorf("duplicate site '%s'", site.Name)
+		}
+		names[site.Name] = true
+		if len(site.Directory) == 0 {
+			return SitesConfig{}, fmt.Errorf("site '%s' has no directory", site.Name)
+		}
+		site.Directory = relative(site.Directory)
+		site.CSP.ConfigFile = relative(site.CSP.ConfigFile)
+		site.ErrorPages = relative(site.ErrorPages)
+		site.Rules = relative(site.Rules)
+		site.Mounts = relative(site.Mounts)
+		for j, bundle := range site.Previous {
+			site.Previous[j] = relative(bundle)
+		}
+		if len(site.BaseHref) == 0 {
+			site.BaseHref = "/"
+		}
+	}
+	return res, nil
+}
+
+// apply returns config with the overrides of the site.
+func (s SiteConfig) apply(config Config) Config {
+	config.Args.Directory = s.Directory
+	config.BaseHref = s.BaseHref
+	config.StripBaseHref = s.StripBaseHref
+	if s.CacheSize > 0 {
+		config.ServerCache.MaxMemorySize = s.CacheSize
+	}
+	if len(s.Mounts) > 0 {
+		config.Mounts = s.Mounts
+	}
+	if len(s.Rules) > 0 {
+		config.Rules = s.Rules
+	}
+	if len(s.ErrorPages) > 0 {
+		config.ErrorPages.Directory = s.ErrorPages
+	}
+	if len(s.Previous) > 0 {
+		config.Previous.Bundles = s.Previous
+	}
+	if s.CSP.Disable == true {
+		config.CSP.Disable = true
+	}
+	if len(s.CSP.Policy) > 0 {
+		config.CSP.Policy = s.CSP.Policy
+		config.CSP.ConfigFile = ""
+	}
+	if len(s.CSP.ConfigFile) > 0 {
+		config.CSP.ConfigFile = s.CSP.ConfigFile
+	}
+	if len(s.CSP.Nonced) > 0 {
+		config.CSP.NoncedPath = s.CSP.Nonced
+	}
+	return config
+}
+
+type site struct {
+	name     string
+	hosts    []string
+	basePath string
+	handler  http.Handler
+}
+
+func (s site) matchPath(p string) bool {
+	return len(s.basePath) == 0 || p == s.basePath || strings.HasPrefix(p, s.basePath+"/")
+}
+
+// normalizeHost lowercases host and removes its port and trailing dot.
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(hostOnly(host), "."))
+}
+
+// validateHostPattern accepts a host name, a wildcard such as
+// '*.example.com' matching any of its subdomains, or '*' for the
+// default host.
+func validateHostPattern(pattern string) error {
+	name := strings.TrimPrefix(pattern, "*.")
+	if pattern == "*" {
+		return nil
+	}
+	if len(name) == 0 || strings.ContainsAny(name, "*:/ ") == true ||
+		strings.HasPrefix(name, ".") == true || strings.HasSuffix(name, ".") == true {
+		return fmt.Errorf("invalid host '%s', expected a name, '*.<domain>' or '*'", pattern)
+	}
+	return nil
+}
+
+// UnknownHostConfig is the response to requests whose host is served
+// by no site, when no site is the default host.
+type UnknownHostConfig struct {
+	Status   int    `json:"status"`
+	Body     string `json:"body"`
+	Redirect string `json:"redirect"`
+}
+
+func (c UnknownHostConfig) validate() error {
+	if len(c.Redirect) > 0 {
+		if c.Status != 0 && (c.Status < 300 || c.Status > 399) {
+			return fmt.Errorf("unknown host redirect needs a 3xx status, got %d", c.Status)
+		}
+		return nil
+	}
+	if c.Status != 0 && (c.Status < 400 || c.Status > 599) {
+		return fmt.Errorf("unknown host status must be an error, got %d", c.Status)
+	}
+	return nil
+}
+
+func (c UnknownHostConfig) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(c.Redirect) > 0 {
+		status := c.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+		http.Redirect(w, req, c.Redirect, status)
+		return
+	}
+	status := c.Status
+	if status == 0 {
+		status = http.StatusMisdirectedRequest
+	}
+	body := c.Body
+	if len(body) == 0 {
+		body = http.StatusText(status)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+// siteTable is the sites serving a host, by decreasing base path
+// length.
+type siteTable []site
+
+func (t siteTable) match(p string) (site, bool) {
+	for _, s := range t {
+		if s.matchPath(p) == true {
+			return s, true
+		}
+	}
+	return site{}, false
+}
+
+// SiteRouter dispatches requests by their Host header to the sites of
+// that host, of the longest matching wildcard or of the default host
+// '*', in that order. Among them, the site with the longest base path
+// matching the request serves it. Sites without hosts serve the
+// default host.
+type SiteRouter struct {
+	hosts       map[string]siteTable
+	wildcards   []string
+	defaults    siteTable
+	unknownHost http.Handler
+}
+
+type SiteRouterOption func(*SiteRouter)
+
+// WithUnknownHost sets the response to hosts served by no site.
+func WithUnknownHost(handler http.Handler) SiteRouterOption {
+	return func(r *SiteRouter) {
+		r.unknownHost = handler
+	}
+}
+
+func NewSiteRouter(sites []site, options ...SiteRouterOption) (*SiteRouter, error) {
+	res := &SiteRouter{
+		hosts:       make(map[string]siteTable),
+		unknownHost: UnknownHostConfig{},
+	}
+	seen := make(map[string]string)
+	for _, s := range sites {
+		hosts := s.hosts
+		if len(hosts) == 0 {
+			hosts = []string{"*"}
+		}
+		for _, host := range hosts {
+			if err := validateHostPattern(host); err != nil {
+				return nil, fmt.Errorf("site '%s': %w", s.name, err)
+			}
+			key := host + s.basePath
+			if other, ok := seen[key]; ok == true {
+				return nil, fmt.Errorf("sites '%s' and '%s' both serve '%s'", other, s.name, key)
+			}
+			seen[key] = s.name
+
+			if host == "*" {
+				res.defaults = append(res.defaults, s)
+				continue
+			}
+			if _, ok := res.hosts[host]; ok == false && strings.HasPrefix(host, "*.") == true {
+				res.wildcards = append(res.wildcards, host)
+			}
+			res.hosts[host] = append(res.hosts[host], s)
+		}
+	}
+
+	byBasePath := func(t siteTable) {
+		sort.SliceStable(t, func(i, j int) bool {
+			return len(t[i].basePath) > len(t[j].basePath)
+		})
+	}
+	for _, t := range res.hosts {
+		byBasePath(t)
+	}
+	byBasePath(res.defaults)
+	// most specific wildcards first.
+	sort.SliceStable(res.wildcards, func(i, j int) bool {
+		return len(res.wildcards[i]) > len(res.wildcards[j])
+	})
+
+	for _, option := range options {
+		option(res)
+	}
+	return res, nil
+}
+
+// tables returns the site tables serving host, from the most to the
+// least specific.
+func (r *SiteRouter) tables(host string) []siteTable {
+	var res []siteTable
+	if t, ok := r.hosts[host]; ok == true {
+		res = append(res, t)
+	}
+	for _, wildcard := range r.wildcards {
+		if strings.HasSuffix(host, wildcard[1:]) == true {
+			res = append(res, r.hosts[wildcard])
+		}
+	}
+	if len(r.defaults) > 0 {
+		res = append(res, r.defaults)
+	}
+	return res
+}
+
+func (r *SiteRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	tables := r.tables(normalizeHost(req.Host))
+	if len(tables) == 0 {
+		zap.L().Info("unknown host",
+			zap.String("host", req.Host),
+			zap.String("URL", req.URL.String()),
+			zap.String("address", req.RemoteAddr))
+		r.unknownHost.ServeHTTP(w, req)
+		return
+	}
+	for _, t := range tables {
+		if s, ok := t.match(req.URL.Path); ok == true {
+			s.handler.ServeHTTP(w, req)
+			return
+		}
+	}
+	zap.L().Info("no site for request",
+		zap.String("host", req.Host),
+		zap.String("URL", req.URL.String()))
+	http.Error(w, "not found", http.StatusNotFound)
+}
+
+// WithSiteName adds the site name to request logs.
+func WithSiteName(name string) HandlerOption {
+	return func(h *Handler) {
+		h.site = name
+	}
+}
+
+// buildSites builds the handler of each site described in
+// --sites, and returns the routes of all sites prefixed by their
+// name for display.
+func buildSites(config Config) (map[string]Route, http.Handler, error) {
+	sitesConfig, err := loadSitesConfig(config.Sites)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(config.Args.Directory) > 0 {
+		return nil, nil, errors.New("--sites replaces the directory argument")
+	}
+
+	maxSize := sitesConfig.MaxMemorySize
+	if maxSize == 0 {
+		maxSize = config.ServerCache.MaxMemorySize
+	}
+	budget := newMemoryBudget(int64(maxSize))
+
+	allRoutes := make(map[string]Route)
+	sites := make([]site, 0, len(sitesConfig.Sites))
+	for _, siteConfig := range sitesConfig.Sites {
+		siteConfig_ := siteConfig.apply(config)
+		routes, handler, err := buildHandler(siteConfig_, budget, WithSiteName(siteConfig.Name))
+		if err != nil {
+			return nil, nil, fmt.Errorf("site '%s': %w", siteConfig.Name, err)
+		}
+		for target, route := range routes {
+			allRoutes[siteConfig.Name+":"+target] = route
+		}
+		basePath, _ := parseBaseHref(siteConfig.BaseHref)
+		hosts := make([]string, len(siteConfig.Hosts))
+		for i, host := range siteConfig.Hosts {
+			hosts[i] = strings.ToLower(strings.TrimSuffix(host, "."))
+		}
+		sites = append(sites, site{
+			name:     siteConfig.Name,
+			hosts:    hosts,
+			basePath: basePath,
+			handler:  handler,
+		})
+	}
+
+	router, err := NewSiteRouter(sites, WithUnknownHost(sitesConfig.UnknownHost))
+	if err != nil {
+		return nil, nil, err
+	}
+	return allRoutes, router, nil
+}
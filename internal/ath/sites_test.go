@@ -0,0 +1,256 @@
+package ath
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type SitesSuite struct{}
+
+var _ = Suite(&SitesSuite{})
+
+func writeSitesFile(c *C, content string) string {
+	dir := c.MkDir()
+	for _, site := range []struct{ Name, BaseHref string }{
+		{"shop", "/"},
+		{"admin", "/admin/"},
+	} {
+		siteDir := filepath.Join(dir, site.Name)
+		c.Assert(os.Mkdir(siteDir, 0755), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(siteDir, "index.html"),
+			[]byte(`<html><head><base href="`+site.BaseHref+`"></head><body>`+site.Name+`</body></html>`), 0644), IsNil)
+	}
+	path := filepath.Join(dir, "sites.json")
+	c.Assert(os.WriteFile(path, []byte(content), 0644), IsNil)
+	return path
+}
+
+func (s *SitesSuite) TestLoad(c *C) {
+	testdata := []struct {
+		Content, Error string
+	}{
+		{`{"sites":[]}`, "'.*' defines no site"},
+		{`{"sites":[{"directory":"shop"}]}`, "site 0 has no name"},
+		{`{"sites":[{"name":"shop"}]}`, "site 'shop' has no directory"},
+		{`{"sites":[{"name":"shop","directory":"shop"},{"name":"shop","directory":"admin"}]}`,
+			"duplicate site 'shop'"},
+		{`{"sites":[{"name":"shop","directory":"shop","cache-size":"1x"}]}`,
+			".*invalid suffix 'x' in '1x'"},
+	}
+	for _, d := range testdata {
+		_, err := loadSitesConfig(writeSitesFile(c, d.Content))
+		c.Check(err, ErrorMatches, d.Error)
+	}
+
+	path := writeSitesFile(c, `{
+"max-memory-size": "10M",
+"sites":[{"name":"shop","directory":"shop","cache-size":1024,"csp":{"config":"csp.json"}}]
+}`)
+	config, err := loadSitesConfig(path)
+	c.Assert(err, IsNil)
+	c.Check(config.MaxMemorySize, Equals, ByteSize(10*1024*1024))
+	c.Assert(config.Sites, HasLen, 1)
+	c.Check(config.Sites[0].Directory, Equals, filepath.Join(filepath.Dir(path), "shop"))
+	c.Check(config.Sites[0].CSP.ConfigFile, Equals, filepath.Join(filepath.Dir(path), "csp.json"))
+	c.Check(config.Sites[0].BaseHref, Equals, "/")
+	c.Check(config.Sites[0].CacheSize, Equals, ByteSize(1024))
+}
+
+func (s *SitesSuite) TestApply(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"--csp.config", "global.json"})
+	c.Assert(err, IsNil)
+
+	site := SiteConfig{Name: "admin", Directory: "admin", BaseHref: "/admin/"}
+	site.CSP.Policy = "default-src 'self'"
+	site.CSP.Nonced = []string{"/admin/index.html"}
+
+	res := site.apply(config)
+	c.Check(res.Args.Directory, Equals, "admin")
+	c.Check(res.BaseHref, Equals, "/admin/")
+	c.Check(res.CSP.Policy, Equals, "default-src 'self'")
+	c.Check(res.CSP.ConfigFile, Equals, "")
+	c.Check(res.CSP.NoncedPath, DeepEquals, []string{"/admin/index.html"})
+	c.Check(res.ServerCache.MaxMemorySize, Equals, config.ServerCache.MaxMemorySize)
+	c.Check(config.BaseHref, Equals, "/")
+}
+
+type namedHandler string
+
+func (h namedHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(h))
+}
+
+func (s *SitesSuite) TestRouter(c *C) {
+	_, err := NewSiteRouter([]site{
+		{name: "a", basePath: "/admin"},
+		{name: "b", basePath: "/admin"},
+	})
+	c.Check(err, ErrorMatches, "sites 'a' and 'b' both serve '\\*/admin'")
+
+	router, err := NewSiteRouter([]site{
+		{name: "shop", handler: namedHandler("shop")},
+		{name: "admin", basePath: "/admin", handler: namedHandler("admin")},
+		{name: "docs", hosts: []string{"docs.example.com"}, handler: namedHandler("docs")},
+	})
+	c.Assert(err, IsNil)
+
+	testdata := []struct {
+		Host, Path, Expected string
+	}{
+		{"example.com", "/", "shop"},
+		{"example.com", "/administration", "shop"},
+		{"example.com", "/admin", "admin"},
+		{"example.com", "/admin/users", "admin"},
+		{"docs.example.com", "/", "docs"},
+		{"DOCS.example.com:8443", "/guide", "docs"},
+		{"docs.example.com", "/admin/", "docs"},
+		{"docs.example.com.", "/", "docs"},
+	}
+	for _, d := range testdata {
+		req := httptest.NewRequest("GET", d.Path, nil)
+		req.Host = d.Host
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		c.Check(w.Body.String(), Equals, d.Expected, Commentf("%s%s", d.Host, d.Path))
+	}
+
+}
+
+func (s *SitesSuite) TestVirtualHosts(c *C) {
+	_, err := NewSiteRouter([]site{{name: "a", hosts: []string{"example.*"}}})
+	c.Check(err, ErrorMatches, "site 'a': invalid host 'example.\\*', expected a name, '\\*.<domain>' or '\\*'")
+	_, err = NewSiteRouter([]site{{name: "a", hosts: []string{"example.com:443"}}})
+	c.Check(err, ErrorMatches, "site 'a': invalid host .*")
+
+	router, err := NewSiteRouter([]site{
+		{name: "acme", hosts: []string{"acme.example.com", "shop.acme.com"}, handler: namedHandler("acme")},
+		{name: "acme-admin", hosts: []string{"acme.example.com"}, basePath: "/admin", handler: namedHandler("acme-admin")},
+		{name: "tenants", hosts: []string{"*.example.com"}, handler: namedHandler("tenants")},
+		{name: "eu", hosts: []string{"*.eu.example.com"}, basePath: "/eu", handler: namedHandler("eu")},
+	})
+	c.Assert(err, IsNil)
+
+	testdata := []struct {
+		Host, Path string
+		Status     int
+		Expected   string
+	}{
+		{"acme.example.com", "/", 200, "acme"},
+		{"acme.example.com", "/admin/x", 200, "acme-admin"},
+		{"shop.acme.com", "/admin/x", 200, "acme"},
+		{"globex.example.com", "/", 200, "tenants"},
+		{"a.b.example.com", "/", 200, "tenants"},
+		{"x.eu.example.com", "/eu/", 200, "eu"},
+		{"x.eu.example.com", "/", 200, "tenants"},
+		{"example.com", "/", 421, "Misdirected Request"},
+		{"other.org", "/", 421, "Misdirected Request"},
+	}
+	for _, d := range testdata {
+		req := httptest.NewRequest("GET", d.Path, nil)
+		req.Host = d.Host
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		c.Check(w.Code, Equals, d.Status, Commentf("%s%s", d.Host, d.Path))
+		c.Check(w.Body.String(), Equals, d.Expected, Commentf("%s%s", d.Host, d.Path))
+	}
+
+	router, err = NewSiteRouter([]site{
+		{name: "acme", hosts: []string{"acme.example.com"}, basePath: "/app", handler: namedHandler("acme")},
+		{name: "default", hosts: []string{"*"}, handler: namedHandler("default")},
+	}, WithUnknownHost(UnknownHostConfig{Redirect: "https://example.com/"}))
+	c.Assert(err, IsNil)
+	for host, expected := range map[string]string{
+		"acme.example.com": "default",
+		"other.org":        "default",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		c.Check(w.Body.String(), Equals, expected, Commentf("%s", host))
+	}
+
+	router, err = NewSiteRouter([]site{
+		{name: "acme", hosts: []string{"acme.example.com"}, basePath: "/app", handler: namedHandler("acme")},
+	}, WithUnknownHost(UnknownHostConfig{Redirect: "https://example.com/"}))
+	c.Assert(err, IsNil)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "other.org"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusFound)
+	c.Check(w.Header().Get("Location"), Equals, "https://example.com/")
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Host = "acme.example.com"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusNotFound)
+}
+
+func (s *SitesSuite) TestUnknownHostConfig(c *C) {
+	testdata := []struct {
+		Config UnknownHostConfig
+		Error  string
+	}{
+		{UnknownHostConfig{}, ""},
+		{UnknownHostConfig{Status: 404, Body: "no such tenant"}, ""},
+		{UnknownHostConfig{Redirect: "https://example.com", Status: 301}, ""},
+		{UnknownHostConfig{Redirect: "https://example.com", Status: 404},
+			"unknown host redirect needs a 3xx status, got 404"},
+		{UnknownHostConfig{Status: 200}, "unknown host status must be an error, got 200"},
+	}
+	for _, d := range testdata {
+		err := d.Config.validate()
+		if len(d.Error) == 0 {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, d.Error)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	UnknownHostConfig{Status: 404, Body: "no such tenant"}.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	c.Check(w.Code, Equals, http.StatusNotFound)
+	c.Check(w.Body.String(), Equals, "no such tenant")
+	c.Check(w.Header().Get("Cache-Control"), Equals, "no-store")
+}
+
+func (s *SitesSuite) TestBuildSites(c *C) {
+	path := writeSitesFile(c, `{
+"sites":[
+  {"name":"shop","directory":"shop"},
+  {"name":"admin","directory":"admin","base-href":"/admin/"}
+]}`)
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"--sites", path})
+	c.Assert(err, IsNil)
+
+	routes, handler, err := buildSites(config)
+	c.Assert(err, IsNil)
+	c.Check(routes["shop:/index.html"], NotNil)
+	c.Check(routes["admin:/admin/index.html"], NotNil)
+
+	for p, expected := range map[string]string{
+		"/":              "shop",
+		"/products/12":   "shop",
+		"/admin/":        "admin",
+		"/admin/users/3": "admin",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		c.Check(w.Code, Equals, http.StatusOK, Commentf("%s", p))
+		c.Check(w.Body.String(), Matches, ".*<body>"+expected+"</body>.*", Commentf("%s", p))
+	}
+
+	_, err = flags.ParseArgs(&config, []string{"--sites", path, "somedir"})
+	c.Assert(err, IsNil)
+	_, _, err = buildSites(config)
+	c.Check(err, ErrorMatches, "--sites replaces the directory argument")
+}
@@ -0,0 +1,239 @@
+package ath
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"text/template"
+	"text/template/parse"
+)
+
+// splicedTemplate is a template whose only action is {{.Nonce}}: the
+// nonce is spliced between each of its static segments.
+type splicedTemplate struct {
+	segments []string
+}
+
+// splitNonceTemplate returns the segments of templ, or false if it
+// uses anything else than {{.Nonce}}.
+func splitNonceTemplate(templ *template.Template) (splicedTemplate, bool) {
+	if templ == nil || templ.Tree == nil {
+		return splicedTemplate{}, false
+	}
+	res := splicedTemplate{segments: []string{""}}
+	for _, node := range templ.Tree.Root.Nodes {
+		switch n := node.(type) {
+		case *parse.TextNode:
+			res.segments[len(res.segments)-1] += string(n.Text)
+		case *parse.ActionNode:
+			if isNonceAction(n) == false {
+				return splicedTemplate{}, false
+			}
+			res.segments = append(res.segments, "")
+		default:
+			return splicedTemplate{}, false
+		}
+	}
+	return res, true
+}
+
+func isNonceAction(n *parse.ActionNode) bool {
+	if len(n.Pipe.Decl) > 0 || len(n.Pipe.Cmds) != 1 || len(n.Pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	field, ok := n.Pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	return ok == true && len(field.Ident) == 1 && field.Ident[0] == "Nonce"
+}
+
+func (t splicedTemplate) size(nonce string) int {
+	res := len(nonce) * (len(t.segments) - 1)
+	for _, s := range t.segments {
+		res += len(s)
+	}
+	return res
+}
+
+func (t splicedTemplate) appendTo(res []byte, nonce string) []byte {
+	for i, s := range t.segments {
+		if i > 0 {
+			res = append(res, nonce...)
+		}
+		res = append(res, s...)
+	}
+	return res
+}
+
+func (t splicedTemplate) Splice(nonce string) string {
+	return string(t.appendTo(make([]byte, 0, t.size(nonce)), nonce))
+}
+
+// splicedPage is a nonced page whose content, CSP and headers are
+// pre-split around the nonce.
+//
+// Static content segments are also pre-compressed as independent
+// sequences of deflate blocks, ending byte aligned without the final
+// bit. Gzip and deflate responses are then a concatenation of these
+// sequences, with the nonce in stored (uncompressed) blocks, a final
+// empty block and the gzip framing.
+type splicedPage struct {
+	content splicedTemplate
+	csp     splicedTemplate
+	headers []splicedTemplate
+
+	// raw content segments, to compute the gzip checksum.
+	raw      [][]byte
+	deflated [][]byte
+}
+
+// newSplicedPage returns nil if the templates of a nonced route use
+// anything else than the nonce, in which case they must be executed.
+func newSplicedPage(templ *template.Template, headers []string) (*splicedPage, error) {
+	content, ok := splitNonceTemplate(templ.Lookup("content"))
+	if ok == false {
+		return nil, nil
+	}
+	csp, ok := splitNonceTemplate(templ.Lookup("CSP"))
+	if ok == false {
+		return nil, nil
+	}
+	res := &splicedPage{
+		content: content,
+		csp:     csp,
+		headers: make([]splicedTemplate, len(headers)),
+	}
+	for i, name := range headers {
+		res.headers[i], ok = splitNonceTemplate(templ.Lookup(noncedHeaderTemplate(name)))
+		if ok == false {
+			return nil, nil
+		}
+	}
+
+	res.raw = make([][]byte, len(content.segments))
+	res.deflated = make([][]byte, len(content.segments))
+	for i, segment := range content.segments {
+		res.raw[i] = []byte(segment)
+		var err error
+		if res.deflated[i], err = deflateSegment(segment); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func deflateSegment(segment string) ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+	writer, err := flate.NewWriter(buffer, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write([]byte(segment)); err != nil {
+		return nil, err
+	}
+	// Flush ends the blocks on a byte boundary, without the final bit.
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	data := buffer.Bytes()
+	return data[0:len(data):len(data)], nil
+}
+
+// Size returns the memory used by the raw and pre-compressed segments.
+func (p *splicedPage) Size() int64 {
+	var res int64
+	for i := range p.deflated {
+		res += int64(cap(p.raw[i]) + cap(p.deflated[i]))
+	}
+	return res
+}
+
+var (
+	gzipHeader        = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}
+	finalDeflateBlock = []byte{0x03, 0x00}
+)
+
+func (p *splicedPage) deflateSize(nonce string) int {
+	slots := len(p.deflated) - 1
+	res := slots*(5+len(nonce)) + len(finalDeflateBlock)
+	for _, d := range p.deflated {
+		res += len(d)
+	}
+	return res
+}
+
+func (p *splicedPage) appendDeflate(res []byte, nonce string) ([]byte, error) {
+	if len(nonce) > 0xffff {
+		return nil, errors.New("nonce too long for a stored deflate block")
+	}
+	for i, d := range p.deflated {
+		if i > 0 {
+			// non-final stored block header, already byte aligned.
+			res = append(res, 0)
+			res = binary.LittleEndian.AppendUint16(res, uint16(len(nonce)))
+			res = binary.LittleEndian.AppendUint16(res, ^uint16(len(nonce)))
+			res = append(res, nonce...)
+		}
+		res = append(res, d...)
+	}
+	return append(res, finalDeflateBlock...), nil
+}
+
+// Deflate returns the raw deflate encoding of the content with nonce.
+func (p *splicedPage) Deflate(nonce string) ([]byte, error) {
+	return p.appendDeflate(make([]byte, 0, p.deflateSize(nonce)), nonce)
+}
+
+// GZIP returns the gzip encoding of the content with nonce.
+func (p *splicedPage) GZIP(nonce string) ([]byte, error) {
+	res := make([]byte, 0, len(gzipHeader)+p.deflateSize(nonce)+8)
+	res = append(res, gzipHeader...)
+	res, err := p.appendDeflate(res, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	var crc uint32
+	for i, raw := range p.raw {
+		if i > 0 {
+			crc = crc32.Update(crc, crc32.IEEETable, []byte(nonce))
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, raw)
+	}
+	res = binary.LittleEndian.AppendUint32(res, crc)
+	return binary.LittleEndian.AppendUint32(res, uint32(p.content.size(nonce))), nil
+}
+
+// Render returns the content with nonce, encoded with comp. Formats
+// that cannot be spliced are compressed on each call.
+func (p *splicedPage) Render(comp Compression, nonce string) ([]byte, error) {
+	if c, ok := comp.(compression); ok == true {
+		switch c.name {
+		case GZIP.name:
+			return p.GZIP(nonce)
+		case Deflate.name:
+			return p.Deflate(nonce)
+		}
+	}
+	content := p.content.appendTo(make([]byte, 0, p.content.size(nonce)), nonce)
+	if _, ok := comp.(identity); ok == true {
+		return content, nil
+	}
+	return CompressAll(comp, bytes.NewReader(content))
+}
+
+// spliceableFirst orders compressions so that the ones that can be
+// spliced are preferred, as compressing a whole page on each request
+// costs more than the few bytes saved by a better algorithm.
+func spliceableFirst(compressions []Compression) []Compression {
+	res := make([]Compression, 0, len(compressions))
+	var others []Compression
+	for _, comp := range compressions {
+		if c, ok := comp.(compression); ok == true && (c.name == GZIP.name || c.name == Deflate.name) {
+			res = append(res, comp)
+		} else {
+			others = append(others, comp)
+		}
+	}
+	return append(res, others...)
+}
@@ -0,0 +1,235 @@
+package ath
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/andybalholm/brotli"
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type SpliceSuite struct{}
+
+var _ = Suite(&SpliceSuite{})
+
+func (s *SpliceSuite) TestSplitNonceTemplate(c *C) {
+	testdata := []struct {
+		Template string
+		Segments []string
+	}{
+		{"no nonce", []string{"no nonce"}},
+		{"", []string{""}},
+		{`<script nonce="{{.Nonce}}"></script>`, []string{`<script nonce="`, `"></script>`}},
+		{"{{.Nonce}}{{ .Nonce }}", []string{"", "", ""}},
+		{"{{.Request.Host}}", nil},
+		{"{{.Nonce | printf \"%s\"}}", nil},
+		{"{{if .Nonce}}a{{end}}", nil},
+		{"{{$n := .Nonce}}", nil},
+	}
+
+	for _, d := range testdata {
+		templ := template.Must(template.New("content").Parse(d.Template))
+		spliced, ok := splitNonceTemplate(templ)
+		c.Check(ok, Equals, d.Segments != nil, Commentf("template: %s", d.Template))
+		if d.Segments != nil {
+			c.Check(spliced.segments, DeepEquals, d.Segments, Commentf("template: %s", d.Template))
+		}
+	}
+}
+
+func benchmarkPage() string {
+	builder := strings.Builder{}
+	builder.WriteString(`<!doctype html><html lang="en"><head><meta charset="utf-8"><title>App</title>` +
+		`<base href="/"><style nonce="CSP_NONCE">`)
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&builder, ".class-%d{margin:%dpx;padding:0 %dpx}", i, i%16, i%8)
+	}
+	builder.WriteString(`</style><link rel="stylesheet" href="styles.ef46db3751d8e999.css"></head>` +
+		`<body><app-root ngCspNonce="CSP_NONCE"></app-root>`)
+	for _, bundle := range []string{"runtime", "polyfills", "main"} {
+		fmt.Fprintf(&builder, `<script src="%s.0123456789abcdef.js" type="module" nonce="CSP_NONCE"></script>`, bundle)
+	}
+	builder.WriteString(`</body></html>`)
+	return builder.String()
+}
+
+func newBenchmarkTemplate() *template.Template {
+	templ := template.Must(template.New("CSP").Parse(`default-src 'self'; script-src 'self' 'nonce-{{.Nonce}}'`))
+	return template.Must(templ.New("content").Parse(strings.ReplaceAll(benchmarkPage(), "CSP_NONCE", "{{.Nonce}}")))
+}
+
+func (s *SpliceSuite) TestRender(c *C) {
+	page, err := newSplicedPage(newBenchmarkTemplate(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(page, NotNil)
+	c.Check(page.Size() > 0, Equals, true)
+
+	for _, nonce := range []string{"abcdef", "", strings.Repeat("n", 43)} {
+		expected := strings.ReplaceAll(benchmarkPage(), "CSP_NONCE", nonce)
+
+		data, err := page.Render(Identity, nonce)
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, expected)
+
+		data, err = page.Render(GZIP, nonce)
+		c.Check(err, IsNil)
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		c.Assert(err, IsNil)
+		decoded, err := io.ReadAll(reader)
+		c.Check(err, IsNil)
+		c.Check(string(decoded), Equals, expected)
+		c.Check(len(data) < len(expected)/2, Equals, true)
+
+		data, err = page.Render(Deflate, nonce)
+		c.Check(err, IsNil)
+		decoded, err = io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		c.Check(err, IsNil)
+		c.Check(string(decoded), Equals, expected)
+
+		data, err = page.Render(Brotli, nonce)
+		c.Check(err, IsNil)
+		decoded, err = io.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+		c.Check(err, IsNil)
+		c.Check(string(decoded), Equals, expected)
+	}
+}
+
+func (s *SpliceSuite) TestNotSpliced(c *C) {
+	templ := template.Must(template.New("CSP").Parse(`script-src 'nonce-{{.Nonce}}'`))
+	templ = template.Must(templ.New("content").Parse(`<html>{{.Nonce}}</html>`))
+	templ = template.Must(templ.New(noncedHeaderTemplate("X-Host")).Parse(`{{.Request.Host}}`))
+
+	page, err := newSplicedPage(templ, []string{"X-Host"})
+	c.Check(err, IsNil)
+	c.Check(page, IsNil)
+
+	page, err = newSplicedPage(templ, nil)
+	c.Check(err, IsNil)
+	c.Check(page, NotNil)
+}
+
+func (s *SpliceSuite) TestSpliceableFirst(c *C) {
+	res := spliceableFirst([]Compression{Brotli, GZIP, Deflate})
+	c.Assert(res, HasLen, 3)
+	c.Check(res[0].(compression).name, Equals, "gzip")
+	c.Check(res[1].(compression).name, Equals, "deflate")
+	c.Check(res[2].(compression).name, Equals, "br")
+}
+
+func (s *SpliceSuite) TestBrowserAcceptEncoding(c *C) {
+	var config Config
+	_, err := flags.ParseArgs(&config, []string{"utest-data/utest-app-nonced", "--compression.threshold", "0"})
+	c.Assert(err, IsNil)
+	routes, err := BuildRoutes(config)
+	c.Assert(err, IsNil)
+	route, ok := routes["/index.html"].(*NoncedRoute)
+	c.Assert(ok, Equals, true)
+	c.Assert(route.page, NotNil)
+
+	// browsers accept brotli, but spliced gzip is cheaper to serve.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br, zstd")
+	w := httptest.NewRecorder()
+	route.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "gzip")
+
+	nonce := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(w.Header().Get("Content-Security-Policy"))
+	c.Assert(nonce, HasLen, 2)
+	spliced, err := route.page.GZIP(nonce[1])
+	c.Assert(err, IsNil)
+	c.Check(w.Body.Bytes(), DeepEquals, spliced)
+
+	// brotli is still used when it is the only accepted encoding.
+	req.Header.Set("Accept-Encoding", "br")
+	w = httptest.NewRecorder()
+	route.ServeHTTP(w, req)
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "br")
+}
+
+func (s *SpliceSuite) TestServeSpliced(c *C) {
+	templ := newBenchmarkTemplate()
+	templ = template.Must(templ.New(noncedHeaderTemplate("X-Nonce")).Parse(`{{.Nonce}}`))
+	page, err := newSplicedPage(templ, []string{"X-Nonce"})
+	c.Assert(err, IsNil)
+	r := NoncedRoute{
+		route:    route{"index.html", "text/html; charset=utf-8", []Compression{GZIP}},
+		template: templ,
+		headers:  []string{"X-Nonce"},
+		page:     page,
+	}
+
+	req := httptest.NewRequest("GET", "/index.html", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Check(w.Header().Get("Cache-Control"), Equals, "no-store")
+
+	nonce := w.Header().Get("X-Nonce")
+	c.Check(nonce, HasLen, 43)
+	c.Check(w.Header().Get("Content-Security-Policy"), Equals,
+		"default-src 'self'; script-src 'self' 'nonce-"+nonce+"'")
+
+	reader, err := gzip.NewReader(w.Body)
+	c.Assert(err, IsNil)
+	decoded, err := io.ReadAll(reader)
+	c.Check(err, IsNil)
+	c.Check(string(decoded), Equals, strings.ReplaceAll(benchmarkPage(), "CSP_NONCE", nonce))
+}
+
+func BenchmarkNoncedRoute(b *testing.B) {
+	templ := newBenchmarkTemplate()
+	page, err := newSplicedPage(templ, nil)
+	if err != nil || page == nil {
+		b.Fatalf("could not split page: %v", err)
+	}
+
+	for _, comp := range []struct {
+		name           string
+		acceptEncoding string
+		compression    Compression
+	}{
+		{"identity", "", nil},
+		{"gzip", "gzip", GZIP},
+		{"deflate", "deflate", Deflate},
+		{"br", "br", Brotli},
+	} {
+		for _, impl := range []struct {
+			name string
+			page *splicedPage
+		}{
+			{"template", nil},
+			{"spliced", page},
+		} {
+			var enabled []Compression
+			if comp.compression != nil {
+				enabled = []Compression{comp.compression}
+			}
+			r := NoncedRoute{
+				route:    route{"index.html", "text/html; charset=utf-8", enabled},
+				template: templ,
+				page:     impl.page,
+			}
+			b.Run(comp.name+"/"+impl.name, func(b *testing.B) {
+				req := httptest.NewRequest("GET", "/index.html", nil)
+				req.Header.Set("Accept-Encoding", comp.acceptEncoding)
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					r.ServeHTTP(httptest.NewRecorder(), req)
+				}
+			})
+		}
+	}
+}
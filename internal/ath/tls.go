@@ -0,0 +1,272 @@
+package ath
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+)
+
+// validateTLS checks the TLS options before any listener is opened.
+func validateTLS(config Config) error {
+	if len(config.TLS.Cert) > 0 && len(config.TLS.Key) == 0 {
+		return errors.New("--tls.cert requires --tls.key")
+	}
+	if len(config.TLS.Key) > 0 && len(config.TLS.Cert) == 0 {
+		return errors.New("--tls.key requires --tls.cert")
+	}
+	if config.TLSEnabled() == true {
+		return nil
+	}
+	if config.Protocol.HTTP3 == true {
+		return errors.New("--protocol.http3 requires TLS")
+	}
+	if len(config.TLS.ClientCA) > 0 {
+		return errors.New("--tls.client-ca requires TLS")
+	}
+	return nil
+}
+
+type certificateStore struct {
+	certFile, keyFile string
+	sniDirectory      string
+
+	mx          sync.RWMutex
+	defaultCert *tls.Certificate
+	byName      map[string]*tls.Certificate
+	fingerprint string
+}
+
+func newCertificateStore(certFile, keyFile, sniDirectory string) (*certificateStore, error) {
+	res := &certificateStore{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		sniDirectory: sniDirectory,
+	}
+	if err := res.reload(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *certificateStore) files() []string {
+	res := []string{}
+	if len(s.certFile) > 0 {
+		res = append(res, s.certFile, s.keyFile)
+	}
+	if len(s.sniDirectory) == 0 {
+		return res
+	}
+	matches, _ := filepath.Glob(filepath.Join(s.sniDirectory, "*.crt"))
+	sort.Strings(matches)
+	for _, cert := range matches {
+		res = append(res, cert, strings.TrimSuffix(cert, ".crt")+".key")
+	}
+	return res
+}
+
+// computeFingerprint summarizes the modification time and size of
+// all certificate files, to detect changes on disk.
+func (s *certificateStore) computeFingerprint() string {
+	builder := strings.Builder{}
+	for _, file := range s.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			fmt.Fprintf(&builder, "%s:missing;", file)
+			continue
+		}
+		fmt.Fprintf(&builder, "%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+	}
+	return builder.String()
+}
+
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading '%s': %w", certFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing '%s': %w", certFile, err)
+	}
+	return &cert, nil
+}
+
+func (s *certificateStore) reload() error {
+	fingerprint := s.computeFingerprint()
+
+	var defaultCert *tls.Certificate
+	byName := make(map[string]*tls.Certificate)
+
+	if len(s.certFile) > 0 {
+		var err error
+		defaultCert, err = loadCertificate(s.certFile, s.keyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(s.sniDirectory) > 0 {
+		matches, err := filepath.Glob(filepath.Join(s.sniDirectory, "*.crt"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(matches)
+		for _, certFile := range matches {
+			cert, err := loadCertificate(certFile, strings.TrimSuffix(certFile, ".crt")+".key")
+			if err != nil {
+				return err
+			}
+			for _, name := range cert.Leaf.DNSNames {
+				byName[strings.ToLower(name)] = cert
+			}
+			if defaultCert == nil {
+				defaultCert = cert
+			}
+		}
+	}
+
+	if defaultCert == nil {
+		return errors.New("no TLS certificate found")
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.defaultCert = defaultCert
+	s.byName = byName
+	s.fingerprint = fingerprint
+	return nil
+}
+
+func (s *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byName[name]; ok == true {
+		return cert, nil
+	}
+	if _, domain, ok := strings.Cut(name, "."); ok == true {
+		if cert, ok := s.byName["*."+domain]; ok == true {
+			return cert, nil
+		}
+	}
+	return s.defaultCert, nil
+}
+
+func (s *certificateStore) changed() bool {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.computeFingerprint() != s.fingerprint
+}
+
+// watch reloads the certificates when they change on disk, until
+// stop is closed. On error, previous certificates are kept.
+func (s *certificateStore) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if s.changed() == false {
+			continue
+		}
+		if err := s.reload(); err != nil {
+			zap.L().Error("could not reload TLS certificates", zap.Error(err))
+			continue
+		}
+		zap.L().Info("reloaded TLS certificates")
+	}
+}
+
+func newTLSConfig(getCertificate certificateGetter) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCertificate,
+		CurvePreferences: []tls.CurveID{
+			tls.X25519,
+			tls.CurveP256,
+			tls.CurveP384,
+		},
+		// Only used for TLS 1.2, TLS 1.3 suites are all considered safe.
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+}
+
+type httpsRedirectHandler struct {
+	port int
+	// next, if set, serves requests whose scheme is already https.
+	next http.Handler
+}
+
+func (h httpsRedirectHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.next != nil && requestScheme(req) == "https" {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	host := req.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	} else {
+		// IPv6 hosts without port are still bracketed.
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if h.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(h.port))
+	} else if strings.Contains(host, ":") == true {
+		host = "[" + host + "]"
+	}
+	target := "https://" + host + req.URL.RequestURI()
+	http.Redirect(w, req, target, http.StatusPermanentRedirect)
+}
+
+// redirectAddresses returns the addresses of the plain HTTP listener
+// of --tls.http-port, on the hosts of the TCP listeners, and the HTTPS
+// port they redirect to.
+func redirectAddresses(config Config) ([]string, int, error) {
+	if config.TLS.HTTPPort == 0 {
+		return nil, 0, nil
+	}
+	addresses, port, err := tcpListenAddresses(config)
+	if err != nil {
+		return nil, 0, fmt.Errorf("--tls.http-port: %w", err)
+	}
+	httpPort := strconv.Itoa(config.TLS.HTTPPort)
+	if len(addresses) == 0 {
+		// only sockets, behind a proxy serving HTTPS on its default
+		// port.
+		return []string{net.JoinHostPort(config.Address, httpPort)}, 443, nil
+	}
+	var res []string
+	for _, address := range addresses {
+		host, _, _ := net.SplitHostPort(address)
+		redirect := net.JoinHostPort(host, httpPort)
+		if slices.Contains(res, redirect) == false {
+			res = append(res, redirect)
+		}
+	}
+	return res, port, nil
+}
@@ -0,0 +1,201 @@
+package ath
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	. "gopkg.in/check.v1"
+)
+
+type TLSSuite struct{}
+
+var _ = Suite(&TLSSuite{})
+
+func writeTestCertificate(c *C, certFile, keyFile string, dnsNames ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	c.Assert(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), IsNil)
+	c.Assert(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), IsNil)
+}
+
+func (s *TLSSuite) TestValidate(c *C) {
+	testdata := []struct {
+		Args  []string
+		Error string
+	}{
+		{[]string{}, ""},
+		{[]string{"--tls.cert", "cert.pem", "--tls.key", "key.pem"}, ""},
+		{[]string{"--tls.cert", "cert.pem"}, "--tls.cert requires --tls.key"},
+		{[]string{"--tls.key", "key.pem"}, "--tls.key requires --tls.cert"},
+		{[]string{"--tls.key", "key.pem", "--tls.sni-dir", "certs"}, "--tls.key requires --tls.cert"},
+		{[]string{"--protocol.http3"}, "--protocol.http3 requires TLS"},
+		{[]string{"--tls.client-ca", "ca.pem"}, "--tls.client-ca requires TLS"},
+	}
+	for _, d := range testdata {
+		var config Config
+		_, err := flags.ParseArgs(&config, d.Args)
+		c.Assert(err, IsNil)
+		if len(d.Error) == 0 {
+			c.Check(validateTLS(config), IsNil, Commentf("%v", d.Args))
+		} else {
+			c.Check(validateTLS(config), ErrorMatches, d.Error, Commentf("%v", d.Args))
+		}
+	}
+}
+
+func (s *TLSSuite) TestRedirectAddresses(c *C) {
+	testdata := []struct {
+		Args      []string
+		Addresses []string
+		Port      int
+		Error     string
+	}{
+		{[]string{}, nil, 0, ""},
+		{[]string{"--port", "443", "--tls.http-port", "80"}, []string{"0.0.0.0:80"}, 443, ""},
+		{[]string{"--listen", "127.0.0.1:8443", "--listen", "[::1]:8443", "--tls.http-port", "8080"},
+			[]string{"127.0.0.1:8080", "[::1]:8080"}, 8443, ""},
+		{[]string{"--listen", "unix:/run/ath.sock", "--tls.http-port", "80"}, []string{"0.0.0.0:80"}, 443, ""},
+		{[]string{"--listen", "127.0.0.1:443", "--listen", "[::1]:8443", "--tls.http-port", "80"}, nil, 0,
+			"--tls.http-port: listen addresses do not share a port, got 443 and 8443"},
+	}
+	for _, d := range testdata {
+		var config Config
+		_, err := flags.ParseArgs(&config, d.Args)
+		c.Assert(err, IsNil)
+		addresses, port, err := redirectAddresses(config)
+		if len(d.Error) > 0 {
+			c.Check(err, ErrorMatches, d.Error, Commentf("%v", d.Args))
+			continue
+		}
+		c.Check(err, IsNil, Commentf("%v", d.Args))
+		c.Check(addresses, DeepEquals, d.Addresses, Commentf("%v", d.Args))
+		c.Check(port, Equals, d.Port, Commentf("%v", d.Args))
+	}
+}
+
+func (s *TLSSuite) TestCertificateSelection(c *C) {
+	dir := c.MkDir()
+	sniDir := filepath.Join(dir, "sni")
+	c.Assert(os.Mkdir(sniDir, 0755), IsNil)
+	writeTestCertificate(c, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), "default.example.com")
+	writeTestCertificate(c, filepath.Join(sniDir, "foo.crt"), filepath.Join(sniDir, "foo.key"), "foo.example.com")
+	writeTestCertificate(c, filepath.Join(sniDir, "wildcard.crt"), filepath.Join(sniDir, "wildcard.key"), "*.bar.example.com")
+
+	store, err := newCertificateStore(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), sniDir)
+	c.Assert(err, IsNil)
+
+	testdata := []struct {
+		ServerName, Expected string
+	}{
+		{"", "default.example.com"},
+		{"unknown.example.com", "default.example.com"},
+		{"FOO.example.com.", "foo.example.com"},
+		{"baz.bar.example.com", "*.bar.example.com"},
+	}
+	for _, d := range testdata {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: d.ServerName})
+		c.Assert(err, IsNil)
+		c.Check(cert.Leaf.Subject.CommonName, Equals, d.Expected, Commentf("%+v", d))
+	}
+
+	store, err = newCertificateStore("", "", sniDir)
+	c.Assert(err, IsNil)
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{})
+	c.Assert(err, IsNil)
+	c.Check(cert.Leaf.Subject.CommonName, Equals, "foo.example.com")
+
+	_, err = newCertificateStore("", "", dir)
+	c.Check(err, ErrorMatches, "no TLS certificate found")
+
+	_, err = newCertificateStore(filepath.Join(dir, "key.pem"), filepath.Join(dir, "key.pem"), "")
+	c.Check(err, ErrorMatches, "loading '.*/key.pem': .*")
+}
+
+func (s *TLSSuite) TestReload(c *C) {
+	dir := c.MkDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(c, certFile, keyFile, "old.example.com")
+
+	store, err := newCertificateStore(certFile, keyFile, "")
+	c.Assert(err, IsNil)
+	stop := make(chan struct{})
+	defer close(stop)
+	go store.watch(5*time.Millisecond, stop)
+
+	writeTestCertificate(c, certFile, keyFile, "new.example.com")
+	// ensures the modification time changes even on coarse filesystems.
+	future := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(certFile, future, future), IsNil)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{})
+		c.Assert(err, IsNil)
+		if cert.Leaf.Subject.CommonName == "new.example.com" {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Fatalf("certificate was not reloaded")
+}
+
+func (s *TLSSuite) TestTLSConfig(c *C) {
+	config := newTLSConfig((&certificateStore{}).GetCertificate)
+	c.Check(config.MinVersion, Equals, uint16(tls.VersionTLS12))
+	c.Check(config.CurvePreferences[0], Equals, tls.X25519)
+	for _, id := range config.CipherSuites {
+		for _, insecure := range tls.InsecureCipherSuites() {
+			c.Check(id, Not(Equals), insecure.ID)
+		}
+	}
+}
+
+func (s *TLSSuite) TestHTTPSRedirect(c *C) {
+	testdata := []struct {
+		Port          int
+		URL, Location string
+	}{
+		{443, "http://example.com/foo?bar=baz", "https://example.com/foo?bar=baz"},
+		{443, "http://example.com:80/", "https://example.com/"},
+		{8443, "http://example.com:8080/app", "https://example.com:8443/app"},
+		{443, "http://[::1]/", "https://[::1]/"},
+		{8443, "http://[::1]/", "https://[::1]:8443/"},
+		{8443, "http://[::1]:8080/", "https://[::1]:8443/"},
+	}
+
+	for _, d := range testdata {
+		w := NewMockResponseWritter()
+		req, err := http.NewRequest("GET", d.URL, nil)
+		c.Assert(err, IsNil)
+		httpsRedirectHandler{port: d.Port}.ServeHTTP(w, req)
+		c.Check(string(w.buffer.Bytes()), ResponseMatches, []string{"HTTP/1.1 308 Ok"})
+		c.Check(w.header.Get("Location"), Equals, d.Location)
+	}
+}